@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// errBoardShrink is returned when a resize would remove tiles from the
+// board.
+var errBoardShrink = errors.New("the board can only grow")
+
+// resizeRequest asks the hub to resize the board. The result is sent on
+// done.
+type resizeRequest struct {
+	width  int
+	height int
+	done   chan error
+}
+
+// authAdmin authenticates a personal access token like
+// authPersonalAccessToken, and additionally requires the user to be listed
+// in the comma separated ADMIN_USERS environment variable.
+func authAdmin(r *http.Request) (*User, error) {
+	user, err := authPersonalAccessToken(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, admin := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && admin == user.Username {
+			return user, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s is not an admin", errUnauthorized, user.Username)
+}
+
+// serveResize serves the '/admin/resize' route for growing the board while
+// rc-place is running. Existing tiles keep their position and new tiles
+// get the default color of the palette.
+func serveResize(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/admin/resize") {
+		return
+	}
+
+	// authenticate
+	user, err := authAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	defer r.Body.Close()
+	var size struct {
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&size); err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errMalformed, err))
+		return
+	}
+	if size.Width <= 0 || size.Height <= 0 || size.Width > maxBoardSize || size.Height > maxBoardSize {
+		writeError(w, fmt.Errorf("%w: invalid board size", errMalformed))
+		return
+	}
+
+	if err := hub.resize(size.Width, size.Height); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("%s resized the board to %dx%d\n", user.Username, size.Width, size.Height)
+}
+
+// resize grows the board to width by height tiles.
+func (h *Hub) resize(width, height int) error {
+	request := resizeRequest{width: width, height: height, done: make(chan error, 1)}
+	h.resizes <- request
+	return <-request.done
+}
+
+// applyResize grows the board to width by height tiles and has the other
+// instances do the same. It must only be called from the hub's goroutine.
+func (h *Hub) applyResize(width, height int) error {
+	if h.archiving || h.status().State == stateArchived {
+		return errCanvasArchived
+	}
+	view := h.view()
+	if width < view.width() || height < view.height() {
+		return errBoardShrink
+	}
+	if err := h.growBoard(width, height); err != nil {
+		return err
+	}
+	h.saveSnapshot(time.Now())
+	h.publish(fanoutMessage{Resize: &fanoutResize{Width: width, Height: height}})
+	return nil
+}
+
+// growBoard grows the board and its store to width by height tiles and
+// sends the resized board to every client. It must only be called from the
+// hub's goroutine.
+func (h *Hub) growBoard(width, height int) error {
+	view := h.view()
+	board := newBoard(width, height, h.palette.DefaultID())
+	for y := range view.tiles {
+		copy(board[y], view.tiles[y])
+	}
+	if err := h.store.Reset(board); err != nil {
+		return err
+	}
+
+	// Placements from before the resize can't be replayed onto the resized
+	// board, so clients resuming from them get the whole board instead.
+	seq := view.seq + 1
+	h.board.Store(boardView{tiles: board, seq: seq})
+	h.updates = updateLog{}
+
+	// encode the messages once for each protocol in use
+	encoded := map[string][][]byte{}
+	for client := range h.clients {
+		if client.protocol == textProtocol {
+			continue
+		}
+		if _, ok := encoded[client.protocol]; !ok {
+			encoded[client.protocol] = [][]byte{
+				encodeResize(client.protocol, seq, width, height),
+				encodeSync(client.protocol, board, h.tileBits, seq),
+			}
+		}
+		if cap(client.send)-len(client.send) < len(encoded[client.protocol]) {
+			close(client.send)
+			delete(h.clients, client)
+			continue
+		}
+		for _, message := range encoded[client.protocol] {
+			client.send <- message
+		}
+	}
+	return nil
+}
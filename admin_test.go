@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postResize calls the resize route as user.
+func postResize(hub *Hub, user, body string) int {
+	pacCache.set("Bearer "+user, User{Id: 1, Username: user})
+	defer pacCache.delete("Bearer " + user)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/resize", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+user)
+	w := httptest.NewRecorder()
+	serveResize(hub, w, req)
+	return w.Code
+}
+
+func TestResize(t *testing.T) {
+	t.Setenv("ADMIN_USERS", "someone-else, admin")
+	hub, server := newTestServer(t)
+	jsonConn := dialTestServer(t, server, "json-user", jsonProtocol)
+	binaryConn := dialTestServer(t, server, "binary-user", binaryProtocol)
+	readEnvelope(t, jsonConn)
+	binaryConn.ReadMessage()
+
+	hub.broadcast <- &InternalMessage{X: 2, Y: 3, Color: 8, User: User{Username: "painter"}}
+	readEnvelope(t, jsonConn)
+	binaryConn.ReadMessage()
+
+	if code := postResize(hub, "painter", `{"width": 150, "height": 120}`); code != http.StatusUnauthorized {
+		t.Fatalf("resize by a non-admin: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := postResize(hub, "admin", `{"width": 50, "height": 120}`); code != http.StatusBadRequest {
+		t.Fatalf("shrinking resize: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := postResize(hub, "admin", `{"width": 150, "height": 120}`); code != http.StatusOK {
+		t.Fatalf("resize: got status %d, want %d", code, http.StatusOK)
+	}
+
+	message, payload := readEnvelope(t, jsonConn)
+	if message.Type != messageResize || string(payload) != `{"width":150,"height":120}` {
+		t.Fatalf("got %s %s, want the new size", message.Type, payload)
+	}
+	message, payload = readEnvelope(t, jsonConn)
+	var tiles tilesPayload
+	if err := json.Unmarshal(payload, &tiles); err != nil || message.Type != messageGetTiles {
+		t.Fatalf("got %s %s, want the resized board", message.Type, payload)
+	}
+	if tiles.Width != 150 || tiles.Height != 120 || tiles.Tiles[3][2] != 8 || tiles.Tiles[119][149] != defaultColor {
+		t.Fatalf("got a %dx%d board, want a 150x120 board keeping the placed tile", tiles.Width, tiles.Height)
+	}
+
+	_, frames, err := binaryConn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames[0] != frameResize || binary.BigEndian.Uint16(frames[9:]) != 150 || binary.BigEndian.Uint16(frames[11:]) != 120 {
+		t.Fatalf("got frame %x, want a resize to 150x120", frames[:13])
+	}
+	// the board frame is in the same message unless the client's writer
+	// sent the resize frame before it was queued
+	board := frames[13:]
+	if len(board) == 0 {
+		if _, board, err = binaryConn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if board[0] != frameBoard || len(board) != 13+150*120/2 {
+		t.Fatalf("got %d bytes after the resize frame, want the resized board", len(board))
+	}
+
+	if err := hub.isInBounds(149, 119); err != nil {
+		t.Errorf("isInBounds(149, 119) = %v after resizing", err)
+	}
+}
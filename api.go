@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -17,22 +19,124 @@ type tileResponse struct {
 	LastEditor  string    `json:"lastEditor"`
 }
 
+type tileHistoryResponse struct {
+	X          int                 `json:"x"`
+	Y          int                 `json:"y"`
+	Placements []placementResponse `json:"placements"`
+	// Next is the before parameter for the next page, if there may be one.
+	Next int64 `json:"next,omitempty"`
+}
+
+type placementResponse struct {
+	ID        int64     `json:"id"`
+	Color     string    `json:"color"`
+	Timestamp time.Time `json:"timestamp"`
+	Editor    string    `json:"editor"`
+}
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// batchTileResult is the result of one placement of a batch.
+type batchTileResult struct {
+	X            int    `json:"x"`
+	Y            int    `json:"y"`
+	Status       string `json:"status"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"`
+	Code         string `json:"code,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Statuses of a batchTileResult.
+const (
+	batchStatusApplied     = "applied"
+	batchStatusRateLimited = "rate_limited"
+	batchStatusInvalid     = "invalid"
+	batchStatusClosed      = "closed"
+)
+
+// maxBatchSize limits the number of placements in a batch.
+const maxBatchSize = 500
+
 type tilesResponseIntFormat struct {
 	Tiles           [][]int `json:"tiles"`
+	X               int     `json:"x"`
+	Y               int     `json:"y"`
 	Height          int     `json:"height"`
 	Width           int     `json:"width"`
 	UpdateLimitInMs int     `json:"updateLimitInMs"`
+	tilesMetadata
 }
 
 type tilesResponseStringFormat struct {
 	Tiles           [][]string `json:"tiles"`
+	X               int        `json:"x"`
+	Y               int        `json:"y"`
 	Height          int        `json:"height"`
 	Width           int        `json:"width"`
 	UpdateLimitInMs int        `json:"updateLimitInMs"`
+	tilesMetadata
+}
+
+// tilesMetadata is the latest edit of every tile in a tiles response,
+// included when asked for.
+type tilesMetadata struct {
+	LastEditors [][]string    `json:"lastEditors,omitempty"`
+	LastUpdated [][]time.Time `json:"lastUpdated,omitempty"`
+}
+
+// newTilesMetadata returns the latest edit of every tile of region.
+func newTilesMetadata(region [][]TileInfo) tilesMetadata {
+	metadata := tilesMetadata{
+		LastEditors: make([][]string, len(region)),
+		LastUpdated: make([][]time.Time, len(region)),
+	}
+	for i, row := range region {
+		metadata.LastEditors[i] = make([]string, len(row))
+		metadata.LastUpdated[i] = make([]time.Time, len(row))
+		for j, info := range row {
+			metadata.LastEditors[i][j] = info.User.Username
+			metadata.LastUpdated[i][j] = info.LastUpdate
+		}
+	}
+	return metadata
 }
 
 // pacCache is a personal access token cache used by the /tile API
-var pacCache = map[string]*User{}
+var pacCache = newUserCache()
+
+// userCache maps tokens to the users they authenticate. It's safe for
+// concurrent use.
+type userCache struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+func newUserCache() *userCache {
+	return &userCache{users: make(map[string]User)}
+}
+
+// get returns a copy of the token's user, if it's cached.
+func (c *userCache) get(token string) (*User, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	user, ok := c.users[token]
+	return &user, ok
+}
+
+func (c *userCache) set(token string, user User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[token] = user
+}
+
+func (c *userCache) delete(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, token)
+}
 
 // serveTile serves the '/tile' API route for programatically getting or updating a tile.
 func serveTile(hub *Hub, w http.ResponseWriter, r *http.Request) {
@@ -49,63 +153,126 @@ func getTile(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// authenticate
-	_, err := authPersonalAccessToken(r)
+	user, err := authPersonalAccessToken(r)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, err)
 		return
 	}
+	setRateLimitHeaders(w, hub.rateLimiter.Peek(user.Username, userRole(user.Username), time.Now()))
 
 	query := r.URL.Query()
 	x, errX := strconv.Atoi(query.Get("x"))
 	y, errY := strconv.Atoi(query.Get("y"))
 
 	if errX != nil || errY != nil {
-		log.Println("Missing or malformed query parameter")
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		writeError(w, fmt.Errorf("%w: missing or malformed query parameter", errMalformed))
 		return
 	}
 
-	if err = isInBounds(x, y); err != nil {
-		log.Println("Index out of bounds")
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err = hub.isInBounds(x, y); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	color := hub.board[y][x]
+	color := hub.view().tiles[y][x]
 
-	var timestamp time.Time
-	var username string
-	if err = postgresClient.QueryRow("SELECT username, timestamp FROM tile_info WHERE x = $1 AND y = $2", x, y).Scan(&username, &timestamp); err != nil {
-		log.Printf("QueryRow failed: %v\n", err)
+	info, err := hub.metadata.GetTileInfo(x, y)
+	if err != nil {
+		log.Printf("GetTileInfo failed: %v\n", err)
 	}
 
-	tile := tileResponse{Color: colorToName[color], X: x, Y: y, LastUpdated: timestamp, LastEditor: username}
+	tile := tileResponse{Color: hub.palette.Name(color), X: x, Y: y, LastUpdated: info.LastUpdate, LastEditor: info.User.Username}
 	resp, err := json.Marshal(tile)
 
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	w.Write(resp)
 	return
 }
 
+// getTileHistory serves the '/tile/history' API route for getting every
+// change to a tile, newest first.
+func getTileHistory(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/tile/history") {
+		return
+	}
+
+	// authenticate
+	user, err := authPersonalAccessToken(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setRateLimitHeaders(w, hub.rateLimiter.Peek(user.Username, userRole(user.Username), time.Now()))
+
+	query := r.URL.Query()
+	x, errX := strconv.Atoi(query.Get("x"))
+	y, errY := strconv.Atoi(query.Get("y"))
+	if errX != nil || errY != nil {
+		writeError(w, fmt.Errorf("%w: missing or malformed query parameter", errMalformed))
+		return
+	}
+
+	if err = hub.isInBounds(x, y); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if l := query.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 || limit > maxHistoryLimit {
+			writeError(w, fmt.Errorf("%w: malformed limit", errMalformed))
+			return
+		}
+	}
+
+	before := int64(math.MaxInt64)
+	if b := query.Get("before"); b != "" {
+		if before, err = strconv.ParseInt(b, 10, 64); err != nil {
+			writeError(w, fmt.Errorf("%w: malformed before", errMalformed))
+			return
+		}
+	}
+
+	placements, err := hub.metadata.GetTileHistory(x, y, before, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	history := tileHistoryResponse{X: x, Y: y, Placements: make([]placementResponse, len(placements))}
+	for i, p := range placements {
+		history.Placements[i] = placementResponse{ID: p.ID, Color: hub.palette.Name(p.Color), Timestamp: p.Timestamp, Editor: p.Username}
+	}
+	if len(placements) == limit {
+		history.Next = placements[len(placements)-1].ID
+	}
+
+	resp, err := json.Marshal(history)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
 func updateTile(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	if !verifyRoute(w, r, http.MethodPost, "/tile") {
 		return
 	}
-	// TODO: respond with JSON bodies always
 
 	// authenticate
 	user, err := authPersonalAccessToken(r)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, err)
 		return
 	}
 
@@ -117,19 +284,101 @@ func updateTile(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 	var j jsonBody
 	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
-		log.Println(err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		setRateLimitHeaders(w, hub.rateLimiter.Peek(user.Username, userRole(user.Username), time.Now()))
+		writeError(w, fmt.Errorf("%w: %v", errMalformed, err))
+		return
+	}
+	err = user.SetTile(hub, j.X, j.Y, j.Color)
+	setRateLimitHeaders(w, hub.rateLimiter.Peek(user.Username, userRole(user.Username), time.Now()))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+// setRateLimitHeaders describes the user's rate limit in the response
+// headers. X-RateLimit-Reset and Retry-After are in seconds, rounded up.
+func setRateLimitHeaders(w http.ResponseWriter, limit RateLimit) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(limit.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(durationToSeconds(limit.Reset), 10))
+	w.Header().Set("Retry-After", strconv.FormatInt(durationToSeconds(limit.RetryAfter), 10))
+}
+
+// durationToMs returns d in milliseconds, rounded up so waiting that long
+// is always enough.
+func durationToMs(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// durationToSeconds returns d in seconds, rounded up.
+func durationToSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// updateTilesBatch serves the '/tiles/batch' API route for placing several
+// tiles in one request. Placements are applied in order while the user's
+// rate limit allows, and the result of each one is returned.
+func updateTilesBatch(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/tiles/batch") {
+		return
+	}
+
+	// authenticate
+	user, err := authPersonalAccessToken(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	defer r.Body.Close()
+	type jsonBody struct {
+		X     int    `json:"x"`
+		Y     int    `json:"y"`
+		Color string `json:"color"`
+	}
+	var placements []jsonBody
+	if err := json.NewDecoder(r.Body).Decode(&placements); err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errMalformed, err))
+		return
+	}
+	if len(placements) > maxBatchSize {
+		writeError(w, fmt.Errorf("%w: batch too large", errMalformed))
 		return
 	}
-	if err := user.SetTile(hub, j.X, j.Y, j.Color); err != nil {
-		log.Println(err)
-		if err.Error() == "unknown color" {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
-		} else {
-			http.Error(w, "Too Early", http.StatusTooEarly)
+
+	results := make([]batchTileResult, len(placements))
+	for i, p := range placements {
+		results[i] = batchTileResult{X: p.X, Y: p.Y, Status: batchStatusApplied}
+		err := user.SetTile(hub, p.X, p.Y, p.Color)
+		if err == nil {
+			continue
+		}
+		if wait, ok := retryAfter(err); ok {
+			results[i].Status = batchStatusRateLimited
+			results[i].RetryAfterMs = durationToMs(wait)
+			continue
 		}
+		results[i].Status = batchStatusInvalid
+		if isCanvasClosed(err) {
+			results[i].Status = batchStatusClosed
+		}
+		results[i].Code = errorCode(err)
+		results[i].Error = err.Error()
+	}
+	setRateLimitHeaders(w, hub.rateLimiter.Peek(user.Username, userRole(user.Username), time.Now()))
+
+	resp, err := json.Marshal(struct {
+		Results []batchTileResult `json:"results"`
+	}{results})
+	if err != nil {
+		writeError(w, err)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
 }
 
 func getTiles(hub *Hub, w http.ResponseWriter, r *http.Request) {
@@ -138,33 +387,88 @@ func getTiles(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// authenticate
-	_, err := authPersonalAccessToken(r)
+	user, err := authPersonalAccessToken(r)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, err)
 		return
 	}
 
 	query := r.URL.Query()
 	format := query.Get("format")
+	withMetadata, _ := strconv.ParseBool(query.Get("metadata"))
+	if withMetadata && query.Get("at") != "" {
+		// tile_info only has the latest edits, so it can't describe the past
+		writeError(w, fmt.Errorf("%w: metadata can't be combined with at", errMalformed))
+		return
+	}
 
+	tiles := hub.view().tiles
+	if at := query.Get("at"); at != "" {
+		timestamp, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: malformed at: %v", errMalformed, err))
+			return
+		}
+		if tiles, err = hub.boardAt(timestamp); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	params := map[string]int{"x": 0, "y": 0, "width": -1, "height": -1}
+	for name := range params {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				writeError(w, fmt.Errorf("%w: malformed query parameter: %v", errMalformed, name))
+				return
+			}
+			params[name] = n
+		}
+	}
+	x, y, width, height := params["x"], params["y"], params["width"], params["height"]
+	if width == -1 {
+		width = len(tiles[0]) - x
+	}
+	if height == -1 {
+		height = len(tiles) - y
+	}
+	if x < 0 || y < 0 || width <= 0 || height <= 0 || width > len(tiles[0])-x || height > len(tiles)-y {
+		writeError(w, fmt.Errorf("%w: the region isn't on the board", errOutOfBounds))
+		return
+	}
+	if x != 0 || y != 0 || width != len(tiles[0]) || height != len(tiles) {
+		tiles = cropBoard(tiles, x, y, width, height)
+	}
+
+	var metadata tilesMetadata
+	if withMetadata {
+		region, err := hub.metadata.GetRegionInfo(x, y, width, height)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		metadata = newTilesMetadata(region)
+	}
+
+	// the time it takes to earn back a placement through the API
+	updateLimitInMs := int(hub.rateLimiter.Peek(user.Username, userRole(user.Username), time.Now()).Interval.Milliseconds())
 	var resp []byte
 	if format == "int" {
-		board := tilesResponseIntFormat{Tiles: hub.board, Height: boardSize, Width: boardSize, UpdateLimitInMs: updateLimitInMs}
+		board := tilesResponseIntFormat{Tiles: tiles, X: x, Y: y, Height: height, Width: width, UpdateLimitInMs: updateLimitInMs, tilesMetadata: metadata}
 		resp, err = json.Marshal(board)
 	} else {
-		board := tilesResponseStringFormat{Tiles: getBoardAsString(hub.board), Height: boardSize, Width: boardSize, UpdateLimitInMs: updateLimitInMs}
+		board := tilesResponseStringFormat{Tiles: getBoardAsString(tiles, hub.palette), X: x, Y: y, Height: height, Width: width, UpdateLimitInMs: updateLimitInMs, tilesMetadata: metadata}
 		resp, err = json.Marshal(board)
 	}
 
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	w.Write(resp)
 	return
 }
@@ -176,10 +480,10 @@ func authPersonalAccessToken(r *http.Request) (*User, error) {
 	// get token
 	pacToken := r.Header.Get("Authorization")
 	if pacToken == "" {
-		return nil, errors.New("missing authentication token")
+		return nil, fmt.Errorf("%w: missing authentication token", errUnauthorized)
 	}
 	// check cache
-	if u, ok := pacCache[pacToken]; ok {
+	if u, ok := pacCache.get(pacToken); ok {
 		return u, nil
 	}
 	// send request to recurse.com
@@ -195,7 +499,7 @@ func authPersonalAccessToken(r *http.Request) (*User, error) {
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("unauthorized")
+		return nil, errUnauthorized
 	}
 
 	// read body
@@ -206,17 +510,17 @@ func authPersonalAccessToken(r *http.Request) (*User, error) {
 	}
 
 	// update cache
-	pacCache[pacToken] = &user
-	return pacCache[pacToken], nil
+	pacCache.set(pacToken, user)
+	return &user, nil
 }
 
-func getBoardAsString(board [][]int) [][]string {
-	boardString := make([][]string, boardSize)
+func getBoardAsString(board [][]int, palette *Palette) [][]string {
+	boardString := make([][]string, len(board))
 
-	for i := 0; i < boardSize; i++ {
-		boardString[i] = make([]string, boardSize)
-		for j := 0; j < boardSize; j++ {
-			boardString[i][j] = colorToName[board[i][j]]
+	for i := range board {
+		boardString[i] = make([]string, len(board[i]))
+		for j := range board[i] {
+			boardString[i][j] = palette.Name(board[i][j])
 		}
 	}
 
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpdateTilesBatch(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// long enough that the third placement is limited however slow the test is
+	hub.rateLimiter = newTokenBucketLimiter(cooldownPolicies(60000))
+	go hub.run()
+
+	pacCache.set("Bearer batch-token", User{Id: 1, Username: "batch-user"})
+	t.Cleanup(func() { pacCache.delete("Bearer batch-token") })
+
+	body := `[{"x": 1, "y": 1, "color": "mauve"}, {"x": 2, "y": 2, "color": "red"}, {"x": 3, "y": 3, "color": "red"}]`
+	req := httptest.NewRequest(http.MethodPost, "/tiles/batch", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer batch-token")
+	w := httptest.NewRecorder()
+	updateTilesBatch(hub, w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var resp struct {
+		Results []batchTileResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{batchStatusInvalid, batchStatusApplied, batchStatusRateLimited}
+	if len(resp.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(resp.Results), len(want))
+	}
+	for i, status := range want {
+		if resp.Results[i].Status != status {
+			t.Errorf("result %d: got status %q, want %q", i, resp.Results[i].Status, status)
+		}
+	}
+	if resp.Results[2].RetryAfterMs <= 0 {
+		t.Errorf("got retryAfterMs %d for a rate limited placement", resp.Results[2].RetryAfterMs)
+	}
+	if remaining, retry := w.Header().Get("X-RateLimit-Remaining"), w.Header().Get("Retry-After"); remaining != "0" || retry == "" || retry == "0" {
+		t.Errorf("got X-RateLimit-Remaining %q and Retry-After %q, want the rate limit after the batch", remaining, retry)
+	}
+}
+
+func TestUpdateTilesBatchTooLarge(t *testing.T) {
+	pacCache.set("Bearer batch-token", User{Id: 1, Username: "batch-user"})
+	t.Cleanup(func() { pacCache.delete("Bearer batch-token") })
+
+	body := "[" + strings.Repeat(`{"x": 0, "y": 0, "color": "red"},`, maxBatchSize) + `{"x": 0, "y": 0, "color": "red"}]`
+	req := httptest.NewRequest(http.MethodPost, "/tiles/batch", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer batch-token")
+	w := httptest.NewRecorder()
+	updateTilesBatch(nil, w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGetTile(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	red, _ := hub.palette.ID("red")
+	hub.setTile(2, 3, red)
+
+	pacCache.set("Bearer tile-token", User{Id: 1, Username: "tile-user"})
+	t.Cleanup(func() { pacCache.delete("Bearer tile-token") })
+
+	req := httptest.NewRequest(http.MethodGet, "/tile?x=2&y=3", nil)
+	req.Header.Set("Authorization", "Bearer tile-token")
+	w := httptest.NewRecorder()
+	getTile(hub, w, req)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got status %d with Content-Type %q, want %d with JSON", w.Code, w.Header().Get("Content-Type"), http.StatusOK)
+	}
+	var resp tileResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.X != 2 || resp.Y != 3 || resp.Color != "red" {
+		t.Errorf("got %+v, want red at (2, 3)", resp)
+	}
+}
+
+func TestGetTilesRegion(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.setTile(2, 3, 8)
+
+	pacCache.set("Bearer region-token", User{Id: 1, Username: "region-user"})
+	t.Cleanup(func() { pacCache.delete("Bearer region-token") })
+
+	req := httptest.NewRequest(http.MethodGet, "/tiles?format=int&x=2&y=3&width=4&height=2&metadata=true", nil)
+	req.Header.Set("Authorization", "Bearer region-token")
+	w := httptest.NewRecorder()
+	getTiles(hub, w, req)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got status %d with Content-Type %q, want %d with JSON", w.Code, w.Header().Get("Content-Type"), http.StatusOK)
+	}
+	var resp tilesResponseIntFormat
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.X != 2 || resp.Y != 3 || resp.Width != 4 || resp.Height != 2 {
+		t.Fatalf("got region at (%d, %d) of %dx%d, want (2, 3) of 4x2", resp.X, resp.Y, resp.Width, resp.Height)
+	}
+	if len(resp.Tiles) != 2 || len(resp.Tiles[0]) != 4 || resp.Tiles[0][0] != 8 || resp.Tiles[1][0] != defaultColor {
+		t.Errorf("got tiles %v", resp.Tiles)
+	}
+	if len(resp.LastEditors) != 2 || len(resp.LastEditors[0]) != 4 || len(resp.LastUpdated) != 2 {
+		t.Errorf("got metadata %+v, want a 4x2 grid", resp.tilesMetadata)
+	}
+
+	for _, query := range []string{"x=-1", "width=0", "x=99&width=2", "y=100", "x=1&width=9223372036854775807", "y=1&height=9223372036854775807", "metadata=true&at=2022-03-21T18:00:00Z"} {
+		req := httptest.NewRequest(http.MethodGet, "/tiles?"+query, nil)
+		req.Header.Set("Authorization", "Bearer region-token")
+		w := httptest.NewRecorder()
+		getTiles(hub, w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGetTilesNonSquare(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(7, 3)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pacCache.set("Bearer region-token", User{Id: 1, Username: "region-user"})
+	t.Cleanup(func() { pacCache.delete("Bearer region-token") })
+
+	req := httptest.NewRequest(http.MethodGet, "/tiles?format=int", nil)
+	req.Header.Set("Authorization", "Bearer region-token")
+	w := httptest.NewRecorder()
+	getTiles(hub, w, req)
+
+	var resp tilesResponseIntFormat
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Width != 7 || resp.Height != 3 || len(resp.Tiles) != 3 || len(resp.Tiles[0]) != 7 {
+		t.Fatalf("got a %dx%d board, want 7x3", resp.Width, resp.Height)
+	}
+
+	if err := hub.isInBounds(6, 2); err != nil {
+		t.Errorf("isInBounds(6, 2) = %v", err)
+	}
+	if err := hub.isInBounds(2, 6); err == nil {
+		t.Error("isInBounds(2, 6) succeeded on a 7x3 board")
+	}
+}
+
+func TestUpdateTileRateLimit(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.rateLimiter = newTokenBucketLimiter(map[Role]rateLimitPolicy{
+		RoleHuman: {Capacity: 1, RefillMs: 10},
+		RoleBot:   {Capacity: 2, RefillMs: 60000},
+	})
+	go hub.run()
+
+	t.Setenv("BOT_USERS", "limited-user")
+	pacCache.set("Bearer limited-token", User{Id: 1, Username: "limited-user"})
+	t.Cleanup(func() { pacCache.delete("Bearer limited-token") })
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer limited-token")
+		w := httptest.NewRecorder()
+		serveTile(hub, w, req)
+		return w
+	}
+
+	for _, tc := range []struct {
+		body                  string
+		code                  int
+		remaining, retryAfter string
+	}{
+		{`{"x": 1, "y": 1, "color": "red"}`, http.StatusOK, "1", "0"},
+		{`{"x": 1, "y": 1, "color": "red"}`, http.StatusOK, "0", "60"},
+		{`{"x": 100, "y": 1, "color": "red"}`, http.StatusBadRequest, "0", "60"},
+		{`{"x": 1, "y": 1, "color": "red"}`, http.StatusTooEarly, "0", "60"},
+	} {
+		w := request(http.MethodPost, "/tile", tc.body)
+		header := w.Header()
+		if w.Code != tc.code || header.Get("X-RateLimit-Limit") != "2" || header.Get("X-RateLimit-Remaining") != tc.remaining || header.Get("Retry-After") != tc.retryAfter {
+			t.Fatalf("POST %s: got %d with headers %v, want %d with %s remaining", tc.body, w.Code, header, tc.code, tc.remaining)
+		}
+		if w.Code == http.StatusTooEarly {
+			var resp errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Code != errorCodeRateLimited || resp.RetryAfterMs <= 59000 || resp.RetryAfterMs > 60000 {
+				t.Fatalf("got body %s, want the remaining cooldown", w.Body)
+			}
+		}
+	}
+
+	w := request(http.MethodGet, "/tile?x=1&y=1", "")
+	if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != "0" || w.Header().Get("X-RateLimit-Reset") != "120" {
+		t.Fatalf("GET /tile: got %d with headers %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// maxBoardImageSize limits the width and height of a board image in
+	// pixels.
+	maxBoardImageSize = 4096
+
+	// boardImageMaxAge is how long, in seconds, a board image may be cached
+	// before it's revalidated.
+	boardImageMaxAge = 10
+)
+
+// gridColor is the color of the lines drawn between tiles.
+var gridColor = color.NRGBA{0x80, 0x80, 0x80, 0xff}
+
+// serveBoardPNG serves the '/board.png' route, an image of the whole board
+// or a rectangle of it.
+//
+// Query parameters:
+//   - x, y (OPTIONAL, default 0): top left tile of the rectangle
+//   - w, h (OPTIONAL, default rest of the board): size of the rectangle
+//   - scale (OPTIONAL, default 1): size of each tile in pixels
+//   - grid (OPTIONAL, default false): draw lines between tiles
+func serveBoardPNG(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/board.png") {
+		return
+	}
+
+	// Check the version first so unchanged boards aren't rendered again.
+	etag := fmt.Sprintf(`"%s"`, hub.boardVersion())
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", boardImageMaxAge))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	query := r.URL.Query()
+	view := hub.view()
+	height, width := view.height(), view.width()
+	params := map[string]int{"x": 0, "y": 0, "w": -1, "h": -1, "scale": 1}
+	for name := range params {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				writeError(w, fmt.Errorf("%w: malformed query parameter: %v", errMalformed, name))
+				return
+			}
+			params[name] = n
+		}
+	}
+	x, y, scale := params["x"], params["y"], params["scale"]
+	rectWidth, rectHeight := params["w"], params["h"]
+	if rectWidth == -1 {
+		rectWidth = width - x
+	}
+	if rectHeight == -1 {
+		rectHeight = height - y
+	}
+	grid, _ := strconv.ParseBool(query.Get("grid"))
+
+	if x < 0 || y < 0 || rectWidth <= 0 || rectHeight <= 0 || rectWidth > width-x || rectHeight > height-y {
+		writeError(w, fmt.Errorf("%w: the rectangle isn't on the board", errOutOfBounds))
+		return
+	}
+	if scale < 1 || scale > maxBoardImageSize/rectWidth || scale > maxBoardImageSize/rectHeight {
+		writeError(w, fmt.Errorf("%w: malformed scale", errMalformed))
+		return
+	}
+
+	palette := hub.palette.ImagePalette()
+	img := renderPaletted(cropBoard(view.tiles, x, y, rectWidth, rectHeight), palette, scale)
+	if grid {
+		drawGrid(img, scale)
+	}
+
+	// encode to a buffer first so errors can still be reported
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// cropBoard returns a copy of the width by height rectangle of the board
+// with its top left tile at (x, y).
+func cropBoard(board [][]int, x, y, width, height int) [][]int {
+	cropped := make([][]int, height)
+	for i := range cropped {
+		cropped[i] = make([]int, width)
+		copy(cropped[i], board[y+i][x:x+width])
+	}
+	return cropped
+}
+
+// drawGrid draws a line along the top and left edge of every tile. It adds
+// gridColor to the image's palette, or uses the closest color if the
+// palette is full.
+func drawGrid(img *image.Paletted, scale int) {
+	if len(img.Palette) < maxPaletteSize {
+		img.Palette = append(img.Palette, gridColor)
+	}
+	gridIndex := uint8(img.Palette.Index(gridColor))
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if x%scale == 0 || y%scale == 0 {
+				img.SetColorIndex(x, y, gridIndex)
+			}
+		}
+	}
+}
+
+// renderPaletted draws the board with each tile as a scale by scale square.
+func renderPaletted(board [][]int, palette color.Palette, scale int) *image.Paletted {
+	height, width := len(board), len(board[0])
+	img := image.NewPaletted(image.Rect(0, 0, width*scale, height*scale), palette)
+	for y := 0; y < height*scale; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+width*scale]
+		for x := range row {
+			row[x] = uint8(board[y/scale][x/scale])
+		}
+	}
+	return img
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeBoardPNG(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.setTile(1, 2, 8)
+
+	r := httptest.NewRequest(http.MethodGet, "/board.png?x=1&y=2&w=3&h=4&scale=5&grid=true", nil)
+	w := httptest.NewRecorder()
+	serveBoardPNG(hub, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 15 || size.Y != 20 {
+		t.Fatalf("image is %v, want 15x20", size)
+	}
+	if got := img.At(2, 2); !sameColor(got, defaultPalette.NRGBA(8)) {
+		t.Errorf("tile color = %v, want %v", got, defaultPalette.NRGBA(8))
+	}
+	if got := img.At(0, 2); !sameColor(got, gridColor) {
+		t.Errorf("grid color = %v, want %v", got, gridColor)
+	}
+
+	// the same version of the board shouldn't be sent again
+	etag := w.Header().Get("ETag")
+	r = httptest.NewRequest(http.MethodGet, "/board.png", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	serveBoardPNG(hub, w, r)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNotModified)
+	}
+
+	for _, query := range []string{"x=99&w=2", "x=1&w=9223372036854775807", "w=2&scale=4611686018427387904"} {
+		r = httptest.NewRequest(http.MethodGet, "/board.png?"+query, nil)
+		w = httptest.NewRecorder()
+		serveBoardPNG(hub, w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("status = %d for %s, want %d", w.Code, query, http.StatusBadRequest)
+		}
+	}
+}
+
+func sameColor(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
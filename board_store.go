@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultColor is the color of a freshly initialized tile with the default
+// palette (cornflowerblue).
+const defaultColor = 5
+
+// Supported numbers of bits per tile of a stored board.
+const (
+	// tileBits4 packs two tiles per byte, enough for 16 colors.
+	tileBits4 = 4
+
+	// tileBits8 packs a tile per byte, enough for 256 colors.
+	tileBits8 = 8
+)
+
+// boardLayout describes how a board is stored.
+type boardLayout struct {
+	width  int
+	height int
+
+	// bits is the number of bits per tile, tileBits4 or tileBits8.
+	bits int
+
+	// blank is the color of tiles that were never set.
+	blank int
+}
+
+// newBoardLayout returns the layout of a board with the default palette.
+func newBoardLayout(width, height int) boardLayout {
+	return boardLayout{width: width, height: height, bits: tileBits4, blank: defaultColor}
+}
+
+// BoardStore persists the colors of the board. Implementations store the
+// board packed as 4 or 8-bit colors, which is the layout of a redis u4 or
+// u8 bitfield.
+type BoardStore interface {
+	// Load returns the stored board, initializing a board of the layout's
+	// dimensions with every tile set to its blank color if nothing has
+	// been stored yet. Boards are stored with their dimensions, so a board
+	// that was resized is loaded at its new size whatever the layout says.
+	Load() ([][]int, error)
+
+	// SetTile stores the color of a single tile.
+	SetTile(x, y, color int) error
+
+	// Snapshot returns the stored board in its packed form.
+	Snapshot() ([]byte, error)
+
+	// Reset replaces the stored board with board, which may have different
+	// dimensions than the stored one.
+	Reset(board [][]int) error
+
+	// Layout returns how the board is stored, with the dimensions of the
+	// stored board once it's loaded.
+	Layout() boardLayout
+}
+
+// newBoardStore creates the BoardStore of a canvas selected by the
+// BOARD_STORE environment variable. Valid values are "redis", "memory" and
+// "file". When unset, redis is used if REDIS_HOST is set and memory
+// otherwise. Unless the canvas sets its StoreKey, the default canvas is
+// stored at REDIS_BOARD_KEY or BOARD_FILE and other canvases at a key or
+// file named after them.
+func newBoardStore(canvas canvasConfig) (BoardStore, error) {
+	kind := os.Getenv("BOARD_STORE")
+	if kind == "" {
+		if _, ok := os.LookupEnv("REDIS_HOST"); ok {
+			kind = "redis"
+		} else {
+			kind = "memory"
+		}
+	}
+
+	layout := boardLayout{width: canvas.Width, height: canvas.Height, bits: canvas.TileBits, blank: canvas.Palette.DefaultID()}
+	switch kind {
+	case "redis":
+		key := canvas.StoreKey
+		if key == "" {
+			base, ok := os.LookupEnv("REDIS_BOARD_KEY")
+			if !ok {
+				return nil, errors.New("REDIS_BOARD_KEY is required for the redis board store")
+			}
+			key = base
+			if canvas.Name != defaultCanvas {
+				key = base + ":" + canvas.Name
+			}
+		}
+		if redisClient == nil {
+			if err := setupRedisClient(); err != nil {
+				return nil, err
+			}
+		}
+		return newRedisBoardStore(redisClient, key, layout), nil
+	case "memory":
+		return newMemoryBoardStore(layout), nil
+	case "file":
+		path := canvas.StoreKey
+		if path == "" {
+			path = os.Getenv("BOARD_FILE")
+			if path == "" {
+				path = "board.bin"
+			}
+			if canvas.Name != defaultCanvas {
+				ext := filepath.Ext(path)
+				path = strings.TrimSuffix(path, ext) + "-" + canvas.Name + ext
+			}
+		}
+		return newFileBoardStore(path, layout)
+	}
+	return nil, errors.New("unknown BOARD_STORE: " + kind)
+}
+
+// boardDimensions returns the width and height of the board set by the
+// BOARD_WIDTH and BOARD_HEIGHT environment variables, each defaulting to
+// defaultBoardSize.
+func boardDimensions() (width, height int, err error) {
+	dimensions := map[string]int{"BOARD_WIDTH": defaultBoardSize, "BOARD_HEIGHT": defaultBoardSize}
+	for name := range dimensions {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxBoardSize {
+			return 0, 0, fmt.Errorf("%s must be between 1 and %d, got %q", name, maxBoardSize, v)
+		}
+		dimensions[name] = n
+	}
+	return dimensions["BOARD_WIDTH"], dimensions["BOARD_HEIGHT"], nil
+}
+
+// checkPackedSize returns an error if packed isn't the size of the layout's
+// board, which means it was stored with other dimensions or tile bits and
+// would be read at the wrong width. stored is whether the layout's
+// dimensions are the ones stored with the board, leaving only the tile
+// bits to blame.
+func (l boardLayout) checkPackedSize(packed []byte, stored bool) error {
+	want := packedSize(l.width, l.height, l.bits)
+	switch {
+	case len(packed) == want:
+		return nil
+	case stored:
+		return fmt.Errorf("stored %dx%d board has %d bytes, but takes %d with %d-bit tiles: set the canvas's tileBits in CANVASES to the bits it was stored with", l.width, l.height, len(packed), want, l.bits)
+	}
+	return fmt.Errorf("stored board has %d bytes, but a %dx%d board of %d-bit tiles has %d: set BOARD_WIDTH and BOARD_HEIGHT, or the canvas's width, height and tileBits in CANVASES, to the ones it was stored with", len(packed), l.width, l.height, l.bits, want)
+}
+
+// packedSize returns the number of bytes a packed board takes.
+func packedSize(width, height, bits int) int {
+	return (width*height*bits + 7) / 8
+}
+
+// newBoard creates a board of the given size with every tile set to color.
+func newBoard(width, height, color int) [][]int {
+	board := make([][]int, height)
+	for y := range board {
+		board[y] = make([]int, width)
+		for x := range board[y] {
+			board[y][x] = color
+		}
+	}
+	return board
+}
+
+// packBoard packs a board into colors of the given number of bits, row by
+// row. 4-bit colors are packed two tiles per byte, with the first tile in
+// the high nibble.
+func packBoard(board [][]int, bits int) []byte {
+	height := len(board)
+	if height == 0 {
+		return nil
+	}
+	width := len(board[0])
+	packed := make([]byte, packedSize(width, height, bits))
+	for y := range board {
+		for x, color := range board[y] {
+			setPackedColor(packed, y*width+x, color, bits)
+		}
+	}
+	return packed
+}
+
+// unpackBoard is the inverse of packBoard. Tiles past the end of packed are
+// left as 0, matching how redis reads bits that were never set.
+func unpackBoard(packed []byte, width, height, bits int) [][]int {
+	board := make([][]int, height)
+	for y := range board {
+		board[y] = make([]int, width)
+	}
+	tiles := len(packed) * 8 / bits
+	if tiles > width*height {
+		tiles = width * height
+	}
+	for offset := 0; offset < tiles; offset++ {
+		board[offset/width][offset%width] = packedColor(packed, offset, bits)
+	}
+	return board
+}
+
+// packedColor returns the color of the tile at offset in a packed board.
+func packedColor(packed []byte, offset, bits int) int {
+	if bits == tileBits8 {
+		return int(packed[offset])
+	}
+	firstColor, secondColor := getColorsFromByte(packed[offset/2])
+	if offset%2 == 0 {
+		return firstColor
+	}
+	return secondColor
+}
+
+// setPackedColor sets the color of the tile at offset in a packed board.
+func setPackedColor(packed []byte, offset, color, bits int) {
+	switch {
+	case bits == tileBits8:
+		packed[offset] = byte(color)
+	case offset%2 == 0:
+		packed[offset/2] = packed[offset/2]&0x0f | byte(color<<4)
+	default:
+		packed[offset/2] = packed[offset/2]&0xf0 | byte(color&0x0f)
+	}
+}
+
+// memoryBoardStore keeps the board in process memory. The board is lost
+// when the process exits, which makes it useful for local development and
+// tests.
+type memoryBoardStore struct {
+	boardLayout
+	packed []byte
+}
+
+func newMemoryBoardStore(layout boardLayout) *memoryBoardStore {
+	return &memoryBoardStore{
+		boardLayout: layout,
+		packed:      packBoard(newBoard(layout.width, layout.height, layout.blank), layout.bits),
+	}
+}
+
+func (s *memoryBoardStore) Load() ([][]int, error) {
+	return unpackBoard(s.packed, s.width, s.height, s.bits), nil
+}
+
+func (s *memoryBoardStore) SetTile(x, y, color int) error {
+	setPackedColor(s.packed, y*s.width+x, color, s.bits)
+	return nil
+}
+
+func (s *memoryBoardStore) Snapshot() ([]byte, error) {
+	packed := make([]byte, len(s.packed))
+	copy(packed, s.packed)
+	return packed, nil
+}
+
+func (s *memoryBoardStore) Reset(board [][]int) error {
+	s.width, s.height = len(board[0]), len(board)
+	s.packed = packBoard(board, s.bits)
+	return nil
+}
+
+func (s *memoryBoardStore) Layout() boardLayout {
+	return s.boardLayout
+}
+
+// fileBoardStore keeps the packed board in a file on disk, after a header
+// holding its dimensions, updating a single byte for every tile that is set.
+type fileBoardStore struct {
+	boardLayout
+	file *os.File
+}
+
+// fileHeaderSize is the size of a board file's header, the width and height
+// of the board as big-endian uint16s.
+const fileHeaderSize = 4
+
+func newFileBoardStore(path string, layout boardLayout) (*fileBoardStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileBoardStore{boardLayout: layout, file: file}, nil
+}
+
+func (s *fileBoardStore) Load() ([][]int, error) {
+	data, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		// initialize the file
+		board := newBoard(s.width, s.height, s.blank)
+		if err := s.Reset(board); err != nil {
+			return nil, err
+		}
+		return board, nil
+	}
+	if len(data) < fileHeaderSize {
+		return nil, fmt.Errorf("board file %s is too short for its header", s.file.Name())
+	}
+	width, height := int(binary.BigEndian.Uint16(data)), int(binary.BigEndian.Uint16(data[2:]))
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("board file %s has an empty %dx%d board", s.file.Name(), width, height)
+	}
+	s.width, s.height = width, height
+	packed := data[fileHeaderSize:]
+	if err := s.checkPackedSize(packed, true); err != nil {
+		return nil, err
+	}
+	return unpackBoard(packed, s.width, s.height, s.bits), nil
+}
+
+func (s *fileBoardStore) SetTile(x, y, color int) error {
+	offset := y*s.width + x
+	tilesPerByte := 8 / s.bits
+	at := int64(fileHeaderSize + offset/tilesPerByte)
+	b := make([]byte, 1)
+	if _, err := s.file.ReadAt(b, at); err != nil && err != io.EOF {
+		return err
+	}
+	setPackedColor(b, offset%tilesPerByte, color, s.bits)
+	_, err := s.file.WriteAt(b, at)
+	return err
+}
+
+func (s *fileBoardStore) Snapshot() ([]byte, error) {
+	data, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < fileHeaderSize {
+		return nil, nil
+	}
+	return data[fileHeaderSize:], nil
+}
+
+// read returns the whole file, header included.
+func (s *fileBoardStore) read() ([]byte, error) {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(s.file)
+}
+
+func (s *fileBoardStore) Reset(board [][]int) error {
+	width, height := len(board[0]), len(board)
+	data := make([]byte, fileHeaderSize, fileHeaderSize+packedSize(width, height, s.bits))
+	binary.BigEndian.PutUint16(data, uint16(width))
+	binary.BigEndian.PutUint16(data[2:], uint16(height))
+	data = append(data, packBoard(board, s.bits)...)
+	if _, err := s.file.WriteAt(data, 0); err != nil {
+		return err
+	}
+	if err := s.file.Truncate(int64(len(data))); err != nil {
+		return err
+	}
+	s.width, s.height = width, height
+	return nil
+}
+
+func (s *fileBoardStore) Layout() boardLayout {
+	return s.boardLayout
+}
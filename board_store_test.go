@@ -0,0 +1,184 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPackUnpackBoard(t *testing.T) {
+	board := [][]int{
+		{0, 1, 2},
+		{3, 4, 15},
+	}
+	packed := packBoard(board, tileBits4)
+	if want := []byte{0x01, 0x23, 0x4f}; !reflect.DeepEqual(packed, want) {
+		t.Fatalf("packBoard() = %x, want %x", packed, want)
+	}
+	if got := unpackBoard(packed, 3, 2, tileBits4); !reflect.DeepEqual(got, board) {
+		t.Fatalf("unpackBoard() = %v, want %v", got, board)
+	}
+
+	board[1][2] = 200
+	packed = packBoard(board, tileBits8)
+	if want := []byte{0, 1, 2, 3, 4, 200}; !reflect.DeepEqual(packed, want) {
+		t.Fatalf("packBoard() with 8 bits = %x, want %x", packed, want)
+	}
+	if got := unpackBoard(packed, 3, 2, tileBits8); !reflect.DeepEqual(got, board) {
+		t.Fatalf("unpackBoard() with 8 bits = %v, want %v", got, board)
+	}
+}
+
+func TestFileBoardStore8Bit(t *testing.T) {
+	layout := boardLayout{width: 3, height: 2, bits: tileBits8, blank: 0}
+	store, err := newFileBoardStore(filepath.Join(t.TempDir(), "board.bin"), layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetTile(1, 1, 255); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]int{{0, 0, 0}, {0, 255, 0}}
+	if got, err := store.Load(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Load() = %v, %v, want %v", got, err, want)
+	}
+}
+
+func TestBoardStores(t *testing.T) {
+	const width, height = 5, 3
+	fileStore, err := newFileBoardStore(filepath.Join(t.TempDir(), "board.bin"), newBoardLayout(width, height))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]BoardStore{
+		"memory": newMemoryBoardStore(newBoardLayout(width, height)),
+		"file":   fileStore,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			board, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(board, newBoard(width, height, defaultColor)) {
+				t.Fatalf("Load() = %v, want a board of defaultColor", board)
+			}
+
+			if err := store.SetTile(3, 1, 8); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.SetTile(0, 2, 15); err != nil {
+				t.Fatal(err)
+			}
+			board[1][3] = 8
+			board[2][0] = 15
+
+			got, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, board) {
+				t.Fatalf("Load() = %v, want %v", got, board)
+			}
+
+			packed, err := store.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(packed, packBoard(board, tileBits4)) {
+				t.Fatalf("Snapshot() = %x, want %x", packed, packBoard(board, tileBits4))
+			}
+
+			grown := newBoard(width+2, height+1, defaultColor)
+			grown[1][3] = 8
+			if err := store.Reset(grown); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.SetTile(width+1, height, 15); err != nil {
+				t.Fatal(err)
+			}
+			grown[height][width+1] = 15
+			if got, err := store.Load(); err != nil || !reflect.DeepEqual(got, grown) {
+				t.Fatalf("Load() after Reset() = %v, %v, want %v", got, err, grown)
+			}
+		})
+	}
+}
+
+func TestBoardDimensions(t *testing.T) {
+	t.Setenv("BOARD_WIDTH", "250")
+	t.Setenv("BOARD_HEIGHT", "")
+	if _, _, err := boardDimensions(); err == nil {
+		t.Fatal("boardDimensions() succeeded with an empty BOARD_HEIGHT")
+	}
+
+	t.Setenv("BOARD_HEIGHT", "75")
+	width, height, err := boardDimensions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != 250 || height != 75 {
+		t.Fatalf("boardDimensions() = %d, %d, want 250, 75", width, height)
+	}
+}
+
+func TestFileBoardStoreKeepsDimensions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "board.bin")
+	store, err := newFileBoardStore(path, newBoardLayout(10, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub, err := newHub(store, noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.setTile(9, 9, 8)
+	if err := hub.applyResize(20, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart with the configured dimensions loads the resized board
+	for _, layout := range []boardLayout{newBoardLayout(10, 10), newBoardLayout(5, 5), newBoardLayout(30, 10)} {
+		restarted, err := newFileBoardStore(path, layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hub, err := newHub(restarted, noopMetadataStore{})
+		if err != nil {
+			t.Fatalf("restart configured for %dx%d: %v", layout.width, layout.height, err)
+		}
+		if view := hub.view(); view.width() != 20 || view.height() != 20 || view.tiles[9][9] != 8 {
+			t.Errorf("restart configured for %dx%d loaded a %dx%d board, want the resized 20x20 one", layout.width, layout.height, view.width(), view.height())
+		}
+		if got := restarted.Layout(); got.width != 20 || got.height != 20 {
+			t.Errorf("Layout() = %dx%d after loading, want 20x20", got.width, got.height)
+		}
+	}
+
+	// the stored dimensions don't help with other tile bits
+	eightBit, err := newFileBoardStore(path, boardLayout{width: 10, height: 10, bits: tileBits8, blank: defaultColor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eightBit.Load(); err == nil || !strings.Contains(err.Error(), "stored 20x20 board") || !strings.Contains(err.Error(), "tileBits") {
+		t.Fatalf("Load() of a 4-bit board as 8-bit = %v, want an error naming the stored dimensions and tileBits", err)
+	}
+}
+
+func TestCheckPackedSize(t *testing.T) {
+	layout := newBoardLayout(10, 10)
+	if err := layout.checkPackedSize(make([]byte, 50), false); err != nil {
+		t.Fatal(err)
+	}
+	// boards stored without their dimensions may have been stored with
+	// other ones
+	err := layout.checkPackedSize(make([]byte, 60), false)
+	if err == nil || !strings.Contains(err.Error(), "BOARD_WIDTH and BOARD_HEIGHT") || strings.Contains(err.Error(), "resize") {
+		t.Errorf("checkPackedSize() = %v, want an error naming the dimensions to set", err)
+	}
+}
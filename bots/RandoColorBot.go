@@ -6,15 +6,15 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
-const (
-	apiUrl = "https://rc-place.fly.dev"
-	max_x  = 100
-	max_y  = 100
-)
+const apiUrl = "https://rc-place.fly.dev"
+
+// size of the board, read from the api on startup
+var max_x, max_y int
 
 var BearerToken string = os.Getenv("PERSONAL_ACCESS_TOKEN")
 
@@ -28,6 +28,10 @@ type PixelStruct struct {
 
 func main() {
 	checkToken()
+	if err := getBoardSize(); err != nil {
+		fmt.Println("Couldn't get the size of the board:", err)
+		os.Exit(1)
+	}
 	colorsAvailable := []string{"black", "forest", "green", "lime", "blue", "cornflowerblue", "sky", "cyan", "red", "burnt-orange", "orange", "yellow", "purple", "hot-pink", "pink", "white"}
 	generalColor := getGeneralBoardColor()
 	fmt.Println("Seems like most of the pixels are: ", generalColor)
@@ -60,6 +64,32 @@ func checkToken() {
 	}
 }
 
+// getBoardSize sets max_x and max_y to the size of the board reported by
+// the api.
+func getBoardSize() error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/tiles", apiUrl), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", BearerToken))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var board struct {
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&board); err != nil {
+		return err
+	}
+	max_x, max_y = board.Width, board.Height
+	return nil
+}
+
 // function that takes an originating color and updates random pixels to a new given color if it matches the originating color
 func updateRandomPixels(originatingColor string, newColor string, numPixelsToUpdate int) {
 	for i := 0; i < numPixelsToUpdate; i++ {
@@ -156,12 +186,31 @@ func updatePixelState(x int, y int, color string) error {
 	}
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", BearerToken))
 
-	_, err = client.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
-	return err
+	defer res.Body.Close()
+
+	// rate limited, wait exactly as long as the server says and try again
+	if res.StatusCode == http.StatusTooEarly {
+		var limited struct {
+			RetryAfterMs int64 `json:"retryAfterMs"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&limited); err != nil {
+			return err
+		}
+		time.Sleep(time.Duration(limited.RetryAfterMs) * time.Millisecond)
+		return updatePixelState(x, y, color)
+	}
+
+	// wait for the rate limit before the next placement
+	if res.Header.Get("X-RateLimit-Remaining") == "0" {
+		retryAfter, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+		time.Sleep(time.Duration(retryAfter) * time.Second)
+	}
+	return nil
 }
 
 // function that given a string array returns a random string from the array
@@ -5,9 +5,6 @@ import requests
 import os
 import time
 
-# Wait period between API calls in seconds
-timeout = 1.1
-
 tiles=[
     ["black", "black", "black", "black", "black", "black", "black", "black", "black", "black", "black", "black"],
     ["black", "white", "white", "white", "white", "white", "white", "white", "white", "white", "white", "black"],
@@ -33,10 +30,17 @@ def set_tile(x, y, color):
     data = { "x": x, "y": y, "color": color}
     headers = { 'Authorization': 'Bearer ' + os.getenv("PERSONAL_ACCESS_TOKEN"), 'Content-Type': "application/json"}
     resp = requests.post(prod_url, json=data, headers=headers)
+    while resp.status_code == 425:
+        # rate limited, wait exactly as long as the server says
+        time.sleep(resp.json()["retryAfterMs"] / 1000)
+        resp = requests.post(prod_url, json=data, headers=headers)
     if resp.status_code == 200:
         print("Tile placed at (%s,%s)" % (x, y))
     else:
         print("Tile not placed at (%s,%s) | Status code: %d | Message: %s" % (x, y, resp.status_code, resp.text))
+    # wait for the rate limit before the next tile
+    if resp.headers.get("X-RateLimit-Remaining") == "0":
+        time.sleep(int(resp.headers.get("Retry-After", "1")))
 
 def main():
     offsetX, offsetY = 5, 75
@@ -44,7 +48,6 @@ def main():
         for x, color in enumerate(tiles[y]):
             if color != "skip":
                 set_tile(offsetX + x, offsetY + y, color)
-                time.sleep(timeout)
 
 if __name__ == "__main__":
     main()
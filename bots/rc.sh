@@ -2,7 +2,6 @@
 
 TARGET='https://rc-place.fly.dev'
 # TARGET='http://localhost:8080'
-TIMEOUT='1s'
 
 tiles=(
     "black black black black black black black black black black black black"
@@ -23,14 +22,32 @@ tiles=(
 )
 
 function set-tile {
-    curl "$TARGET/tile" \
+    curl -s -D - -o /dev/null "$TARGET/tile" \
         -d '{"x": '"$1"', "y": '"$2"', "color": "'"$3"'"}' \
-        -H "Authorization: Bearer $PERSONAL_ACCESS_TOKEN"
+        -H "Authorization: Bearer $PERSONAL_ACCESS_TOKEN" | tr -d '\r'
 }
 
+# header prints the value of a header from the headers on stdin
+function header {
+    grep -i "^$1:" | cut -d ' ' -f 2
+}
+
+# set-tile-sleep places a tile, retrying while rate limited, and waits
+# until the next tile can be placed
 function set-tile-sleep {
-    set-tile "$@"
-    sleep "$TIMEOUT"
+    while true; do
+        headers=$(set-tile "$@")
+        status=$(head -n 1 <<< "$headers" | cut -d ' ' -f 2)
+        retry_after=$(header Retry-After <<< "$headers")
+        if [[ "$status" != "425" ]]; then
+            break
+        fi
+        sleep "${retry_after:-1}"
+    done
+    echo "($1, $2) $3: $status"
+    if [[ "$(header X-RateLimit-Remaining <<< "$headers")" == "0" ]]; then
+        sleep "${retry_after:-1}"
+    fi
 }
 
 y=${2:-44}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultCanvas is the name of the canvas served at the root of the site
+// when no canvases are configured.
+const defaultCanvas = "main"
+
+// canvasNamePattern matches valid canvas names, which are used in urls and
+// storage keys.
+var canvasNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// canvasConfig configures a canvas. Zero values are replaced with the
+// defaults from the environment.
+type canvasConfig struct {
+	Name string `json:"name"`
+
+	// Width and Height default to BOARD_WIDTH and BOARD_HEIGHT.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// CooldownMs is the time before a user can update the canvas again,
+	// for roles without a rate limit in RateLimits.
+	CooldownMs int `json:"cooldownMs"`
+
+	// RateLimits sets the token bucket of each role.
+	RateLimits map[Role]rateLimitPolicy `json:"rateLimits"`
+
+	// Palette defaults to defaultPalette.
+	Palette *Palette `json:"palette"`
+
+	// TileBits is the number of bits each tile is stored in, tileBits4 or
+	// tileBits8. It defaults to the fewest bits that fit the palette.
+	TileBits int `json:"tileBits"`
+
+	// State is the state the canvas starts in: draft, open or frozen. It
+	// defaults to draft if OpensAt is set and open otherwise. Canvases
+	// archived by a previous run stay archived.
+	State canvasState `json:"state"`
+
+	// OpensAt is when a draft canvas opens, and ClosesAt is when an open
+	// canvas is frozen. Both are optional.
+	OpensAt  time.Time `json:"opensAt"`
+	ClosesAt time.Time `json:"closesAt"`
+
+	// StoreKey is where the board is stored: the redis key or board file.
+	// See newBoardStore for the defaults.
+	StoreKey string `json:"storeKey"`
+}
+
+// loadCanvasConfigs reads the canvases from the json file at the path in
+// the CANVASES environment variable, a list of canvasConfigs. The first
+// canvas is also served at the root of the site. When CANVASES is unset,
+// there is a single canvas named defaultCanvas.
+func loadCanvasConfigs() ([]canvasConfig, error) {
+	width, height, err := boardDimensions()
+	if err != nil {
+		return nil, err
+	}
+
+	configs := []canvasConfig{{Name: defaultCanvas}}
+	if path := os.Getenv("CANVASES"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if err := json.NewDecoder(file).Decode(&configs); err != nil {
+			return nil, fmt.Errorf("reading %s: %v", path, err)
+		}
+		if len(configs) == 0 {
+			return nil, fmt.Errorf("%s doesn't configure any canvases", path)
+		}
+	}
+
+	names := map[string]bool{}
+	for i := range configs {
+		config := &configs[i]
+		if !canvasNamePattern.MatchString(config.Name) {
+			return nil, fmt.Errorf("invalid canvas name %q", config.Name)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("canvas %q is configured more than once", config.Name)
+		}
+		names[config.Name] = true
+
+		if config.Width == 0 {
+			config.Width = width
+		}
+		if config.Height == 0 {
+			config.Height = height
+		}
+		if config.CooldownMs == 0 {
+			config.CooldownMs = defaultUpdateLimitInMs
+		}
+		if config.Width < 0 || config.Height < 0 || config.Width > maxBoardSize || config.Height > maxBoardSize || config.CooldownMs < 0 {
+			return nil, fmt.Errorf("canvas %q has an invalid size or cooldown", config.Name)
+		}
+
+		policies := cooldownPolicies(config.CooldownMs)
+		for role, policy := range config.RateLimits {
+			if _, ok := policies[role]; !ok {
+				return nil, fmt.Errorf("canvas %q: unknown role %q", config.Name, role)
+			}
+			if err := policy.validate(); err != nil {
+				return nil, fmt.Errorf("canvas %q: rate limit of %s: %v", config.Name, role, err)
+			}
+			policies[role] = policy
+		}
+		config.RateLimits = policies
+
+		if config.State == "" {
+			config.State = stateOpen
+			if !config.OpensAt.IsZero() {
+				config.State = stateDraft
+			}
+		}
+		if config.State != stateDraft && config.State != stateOpen && config.State != stateFrozen {
+			return nil, fmt.Errorf("canvas %q: state must be %s, %s or %s", config.Name, stateDraft, stateOpen, stateFrozen)
+		}
+		if !config.OpensAt.IsZero() && !config.ClosesAt.IsZero() && !config.ClosesAt.After(config.OpensAt) {
+			return nil, fmt.Errorf("canvas %q closes before it opens", config.Name)
+		}
+
+		if config.Palette == nil {
+			config.Palette = defaultPalette
+		} else if err := config.Palette.init(); err != nil {
+			return nil, fmt.Errorf("canvas %q: %v", config.Name, err)
+		}
+		if config.TileBits == 0 {
+			config.TileBits = tileBits4
+			if len(config.Palette.Colors) > 1<<tileBits4 {
+				config.TileBits = tileBits8
+			}
+		}
+		if config.TileBits != tileBits4 && config.TileBits != tileBits8 {
+			return nil, fmt.Errorf("canvas %q: tileBits must be %d or %d", config.Name, tileBits4, tileBits8)
+		}
+		if len(config.Palette.Colors) > 1<<config.TileBits {
+			return nil, fmt.Errorf("canvas %q: %d colors don't fit in %d bits", config.Name, len(config.Palette.Colors), config.TileBits)
+		}
+	}
+	return configs, nil
+}
+
+// newCanvas creates the hub of a canvas, loading its board from the
+// configured store. Scheduled state changes that are already due are
+// applied.
+func newCanvas(config canvasConfig, metadata TileMetadataStore) (*Hub, error) {
+	store, err := newBoardStore(config)
+	if err != nil {
+		return nil, err
+	}
+	metadata = metadata.Canvas(config.Name)
+
+	// check that the board store and tile_info agree, since a board store
+	// that lost its data is silently reinitialized
+	mode, err := reconcileMode()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := reconcile(config.Name, store, metadata, mode); err != nil && !errors.Is(err, errNoHistory) {
+		log.Printf("Error reconciling canvas %s: %v\n", config.Name, err)
+	}
+
+	hub, err := newHub(store, metadata)
+	if err != nil {
+		return nil, err
+	}
+	hub.name = config.Name
+	hub.palette = config.Palette
+	if hub.rateLimiter, err = newRateLimiter(config); err != nil {
+		return nil, err
+	}
+
+	status := canvasStatus{State: config.State}
+	if !config.OpensAt.IsZero() {
+		status.OpensAt = &config.OpensAt
+	}
+	if !config.ClosesAt.IsZero() {
+		status.ClosesAt = &config.ClosesAt
+	}
+	if isArchived(config.Name) {
+		status = canvasStatus{State: stateArchived}
+	}
+	hub.lifecycle.Store(status)
+	hub.applySchedule(time.Now())
+	return hub, nil
+}
+
+// canvasRoutes returns the routes of the canvas served by hub, relative to
+// the canvas's path.
+func canvasRoutes(hub *Hub) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		serveHome(hub, w, r)
+	})
+	mux.HandleFunc("/tile", func(w http.ResponseWriter, r *http.Request) {
+		serveTile(hub, w, r)
+	})
+	mux.HandleFunc("/tile/history", func(w http.ResponseWriter, r *http.Request) {
+		getTileHistory(hub, w, r)
+	})
+	mux.HandleFunc("/tiles", func(w http.ResponseWriter, r *http.Request) {
+		getTiles(hub, w, r)
+	})
+	mux.HandleFunc("/tiles/batch", func(w http.ResponseWriter, r *http.Request) {
+		updateTilesBatch(hub, w, r)
+	})
+	mux.HandleFunc("/palette", func(w http.ResponseWriter, r *http.Request) {
+		servePalette(hub, w, r)
+	})
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		serveFavicon(hub, w, r)
+	})
+	mux.HandleFunc("/board.png", func(w http.ResponseWriter, r *http.Request) {
+		serveBoardPNG(hub, w, r)
+	})
+	mux.HandleFunc("/timelapse.gif", func(w http.ResponseWriter, r *http.Request) {
+		serveTimelapse(hub, w, r)
+	})
+	mux.HandleFunc("/admin/resize", func(w http.ResponseWriter, r *http.Request) {
+		serveResize(hub, w, r)
+	})
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		serveState(hub, w, r)
+	})
+	mux.HandleFunc("/admin/state", func(w http.ResponseWriter, r *http.Request) {
+		serveSetState(hub, w, r)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(hub, w, r)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		session, err := getSession(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+		serveWs(hub, &session.User, w, r)
+	})
+	return mux
+}
+
+// canvasRouter serves the '/c/{name}/' routes of every canvas, by name.
+type canvasRouter map[string]http.Handler
+
+func (c canvasRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/c/")
+	name := path
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		name = path[:i]
+	}
+	routes, ok := c[name]
+	if !ok {
+		writeError(w, fmt.Errorf("%w: no canvas named %q", errNotFound, name))
+		return
+	}
+	if name == path {
+		http.Redirect(w, r, "/c/"+name+"/", http.StatusMovedPermanently)
+		return
+	}
+	http.StripPrefix("/c/"+name, routes).ServeHTTP(w, r)
+}
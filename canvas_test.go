@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadCanvasConfigs(t *testing.T) {
+	for _, env := range []string{"BOARD_WIDTH", "BOARD_HEIGHT"} {
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+	t.Setenv("CANVASES", "")
+	configs, err := loadCanvasConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (canvasConfig{Name: defaultCanvas, Width: defaultBoardSize, Height: defaultBoardSize, CooldownMs: defaultUpdateLimitInMs, RateLimits: cooldownPolicies(defaultUpdateLimitInMs), State: stateOpen, Palette: defaultPalette, TileBits: tileBits4}); len(configs) != 1 || !reflect.DeepEqual(configs[0], want) {
+		t.Fatalf("loadCanvasConfigs() = %+v, want only %+v", configs, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "canvases.json")
+	t.Setenv("CANVASES", path)
+	for contents, ok := range map[string]bool{
+		`[{"name": "main"}, {"name": "sandbox", "width": 20, "height": 10, "cooldownMs": 1000}]`: true,
+		`[{"name": "main"}, {"name": "main"}]`:                                                   false,
+		`[{"name": "Not/A/Name"}]`:                                                               false,
+		`[{"name": "huge", "width": 100000}]`:                                                    false,
+		`[]`:                                                                                     false,
+		`[{"name": "main"}, {"name": "sandbox", "width": 20, "cooldownMs": 1000, "palette": {"colors": [{"name": "white", "rgb": "#ffffff"}], "default": "white"}}]`: true,
+		`[{"name": "main", "palette": {"colors": [{"name": "white", "rgb": "white"}], "default": "white"}}]`:                                                         false,
+		`[{"name": "main", "tileBits": 2}]`:                                                         false,
+		`[{"name": "main", "state": "archived"}]`:                                                   false,
+		`[{"name": "main", "opensAt": "2026-01-02T00:00:00Z", "closesAt": "2026-01-01T00:00:00Z"}]`: false,
+	} {
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		configs, err := loadCanvasConfigs()
+		if ok != (err == nil) {
+			t.Errorf("loadCanvasConfigs() with %s: got error %v", contents, err)
+		}
+		if ok && (len(configs) != 2 || configs[1].Width != 20 || configs[1].CooldownMs != 1000 || configs[0].Width != defaultBoardSize) {
+			t.Errorf("loadCanvasConfigs() with %s = %+v", contents, configs)
+		}
+	}
+}
+
+func TestCanvasRouter(t *testing.T) {
+	canvases := canvasRouter{}
+	for _, config := range []canvasConfig{
+		{Name: "main", Width: 10, Height: 10, CooldownMs: 10, RateLimits: cooldownPolicies(10), State: stateOpen, Palette: defaultPalette, TileBits: tileBits4},
+		{Name: "sandbox", Width: 20, Height: 5, CooldownMs: 1000, RateLimits: cooldownPolicies(1000), State: stateOpen, Palette: defaultPalette, TileBits: tileBits8},
+	} {
+		hub, err := newCanvas(config, noopMetadataStore{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		canvases[config.Name] = canvasRoutes(hub)
+	}
+
+	pacCache.set("Bearer canvas-token", User{Id: 1, Username: "canvas-user"})
+	t.Cleanup(func() { pacCache.delete("Bearer canvas-token") })
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer canvas-token")
+		w := httptest.NewRecorder()
+		canvases.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/c/sandbox/tiles?format=int")
+	var resp tilesResponseIntFormat
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("got %d %s: %v", w.Code, w.Body, err)
+	}
+	if resp.Width != 20 || resp.Height != 5 || resp.UpdateLimitInMs != 1000 {
+		t.Fatalf("got a %dx%d board with a %dms cooldown, want the sandbox canvas", resp.Width, resp.Height, resp.UpdateLimitInMs)
+	}
+
+	if w := get("/c/nowhere/tiles"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown canvas: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := get("/c/main"); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/c/main/" {
+		t.Errorf("canvas without a trailing slash: got status %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -26,58 +25,24 @@ const (
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
 
-	// Time before a user can update the canvas again.
-	updateLimitInMs = 10
-	updateLimit     = updateLimitInMs * time.Millisecond
+	// Number of outbound messages buffered for a peer before it's dropped
+	// for being too slow.
+	sendBufferSize = 256
+
+	// Time before a user can update a canvas again, unless the canvas
+	// configures its own cooldown.
+	defaultUpdateLimitInMs = 10
+	defaultUpdateLimit     = defaultUpdateLimitInMs * time.Millisecond
 )
 
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
 
-	lastUpdateCache = map[string]time.Time{}
-
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-	}
-
-	nameToColor = map[string]int{
-		"black":          0,
-		"forest":         1,
-		"green":          2,
-		"lime":           3,
-		"blue":           4,
-		"cornflowerblue": 5,
-		"sky":            6,
-		"cyan":           7,
-		"red":            8,
-		"burnt-orange":   9,
-		"orange":         10,
-		"yellow":         11,
-		"purple":         12,
-		"hot-pink":       13,
-		"pink":           14,
-		"white":          15,
-	}
-
-	colorToName = map[int]string{
-		0:  "black",
-		1:  "forest",
-		2:  "green",
-		3:  "lime",
-		4:  "blue",
-		5:  "cornflowerblue",
-		6:  "sky",
-		7:  "cyan",
-		8:  "red",
-		9:  "burnt-orange",
-		10: "orange",
-		11: "yellow",
-		12: "purple",
-		13: "hot-pink",
-		14: "pink",
-		15: "white",
+		Subprotocols:    []string{binaryProtocol, jsonProtocol},
 	}
 )
 
@@ -91,8 +56,32 @@ type Client struct {
 	// Buffered channel of outbound messages.
 	send chan []byte
 
+	// Buffered channel of replies to this client's messages.
+	replies chan []byte
+
 	// User this websocket is associated with.
 	user *User
+
+	// Websocket subprotocol negotiated with the client.
+	protocol string
+
+	// Sequence number of the last placement the client saw before
+	// reconnecting, or 0 for a new session.
+	since uint64
+
+	// syncView is the board the hub syncs the client with, which is sent
+	// in place of a nil message on send. It's encoded by the client rather
+	// than on the hub's goroutine, as that takes as long as the board is
+	// large.
+	syncView boardView
+}
+
+// encoded returns message, or the encoded syncView if it's nil.
+func (c *Client) encoded(message []byte) []byte {
+	if message == nil {
+		return encodeSync(c.protocol, c.syncView.tiles, c.hub.tileBits, c.syncView.seq)
+	}
+	return message
 }
 
 type User struct {
@@ -100,22 +89,36 @@ type User struct {
 	Username string `json:"slug"`
 }
 
+// takePlacement uses one of the user's placements on the hub's canvas,
+// returning a rateLimitedError if they have none left.
+func (h *Hub) takePlacement(username string) error {
+	if limit := h.rateLimiter.Take(username, userRole(username), time.Now()); !limit.Allowed {
+		return rateLimitedError{limit}
+	}
+	return nil
+}
+
 func (u *User) SetTile(hub *Hub, x, y int, color string) error {
-	if time.Since(lastUpdateCache[u.Username]) < updateLimit {
-		return errors.New("rate limited")
+	if err := hub.checkOpen(); err != nil {
+		return err
 	}
 	// validate color
-	colInt, ok := nameToColor[color]
+	colInt, ok := hub.palette.ID(color)
 	if !ok {
-		return errors.New("unknown color")
+		return fmt.Errorf("%w %q", errUnknownColor, color)
 	}
 
-	internalMessage, err := createInternalMessage(fmt.Sprintf("%d %d %d", x, y, colInt), *u, time.Now())
+	internalMessage, err := createInternalMessage(hub, fmt.Sprintf("%d %d %d", x, y, colInt), *u, time.Now())
 	if err != nil {
 		log.Println("Failed to createInternalMessage")
 		return err
 	}
 
+	// Only valid placements use up the rate limit.
+	if err := hub.takePlacement(u.Username); err != nil {
+		return err
+	}
+
 	hub.broadcast <- internalMessage
 	return nil
 }
@@ -141,29 +144,38 @@ func (c *Client) readPump() {
 			}
 			break
 		}
-		// TODO: structured commands
+		if c.protocol != textProtocol {
+			c.handleJSONMessage(webSocketMessage)
+			continue
+		}
+
 		webSocketMessage = bytes.TrimSpace(bytes.Replace(webSocketMessage, newline, space, -1))
 
 		message := string(webSocketMessage)
 		// Try to parse message and send board if so.
 		if message == "getTiles" {
-			if err = c.conn.WriteJSON(c.hub.board); err != nil {
-				log.Println("uh oh, failed to send board:", err)
-			}
+			c.reply(encodeBoard(c.protocol, "", c.hub.view().tiles, c.hub.tileBits, 0))
 			continue
 		}
 
-		// check if this user can send a message
-		if time.Since(lastUpdateCache[c.user.Username]) < updateLimit {
+		// The text protocol has no way to report errors, so placements on
+		// a closed canvas are only logged.
+		if err := c.hub.checkOpen(); err != nil {
+			log.Printf("Rejected placement by %s: %v\n", c.user.Username, err)
 			continue
 		}
 
-		internalMessage, err := createInternalMessage(message, *c.user, time.Now())
+		internalMessage, err := createInternalMessage(c.hub, message, *c.user, time.Now())
 		if err != nil {
 			log.Printf("Failed to createInternalMessage %v\n", err)
 			continue
 		}
 
+		// check if this user can send a message
+		if err := c.hub.takePlacement(c.user.Username); err != nil {
+			continue
+		}
+
 		c.hub.broadcast <- internalMessage
 	}
 }
@@ -180,48 +192,52 @@ func (c *Client) writePump() {
 		c.conn.Close()
 	}()
 
-	// send messages to initialize board state
-	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	w, err := c.conn.NextWriter(websocket.TextMessage)
-	if err != nil {
-		return
-	}
-	for y := range c.hub.board {
-		for x := range c.hub.board[y] {
-			msg := fmt.Sprintf("%d %d %d\n", x, y, c.hub.board[y][x])
-			w.Write([]byte(msg))
-		}
-	}
-	if err := w.Close(); err != nil {
-		return
-	}
-
 	for {
 		select {
 		case message, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				// The hub closed the channel, either because the client
+				// disconnected or because it fell behind. In the latter
+				// case it can reconnect and resume its session.
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "resume from the last seq"))
 				return
 			}
+			message = c.encoded(message)
+
+			// Every json message is sent in its own websocket message.
+			if c.protocol == jsonProtocol {
+				if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+					return
+				}
+				continue
+			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
+			w, err := c.conn.NextWriter(messageType(c.protocol, message))
 			if err != nil {
 				return
 			}
 			w.Write(message)
 
 			// Add queued chat messages to the current websocket message.
+			// Binary frames are self delimiting, so they're simply
+			// concatenated.
 			n := len(c.send)
 			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.send)
+				if c.protocol == textProtocol {
+					w.Write(newline)
+				}
+				w.Write(c.encoded(<-c.send))
 			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
+		case reply := <-c.replies:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(messageType(c.protocol, reply), reply); err != nil {
+				return
+			}
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -238,7 +254,18 @@ func serveWs(hub *Hub, user *User, w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 		return
 	}
-	client := &Client{hub: hub, user: user, conn: conn, send: make(chan []byte, 256)}
+	// Clients resuming a session send the last sequence number they saw.
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+
+	client := &Client{
+		hub:      hub,
+		user:     user,
+		conn:     conn,
+		send:     make(chan []byte, sendBufferSize),
+		replies:  make(chan []byte, 16),
+		protocol: conn.Subprotocol(),
+		since:    since,
+	}
 	client.hub.register <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -247,12 +274,12 @@ func serveWs(hub *Hub, user *User, w http.ResponseWriter, r *http.Request) {
 	go client.readPump()
 }
 
-func createInternalMessage(message string, user User, timestamp time.Time) (*InternalMessage, error) {
+func createInternalMessage(hub *Hub, message string, user User, timestamp time.Time) (*InternalMessage, error) {
 	parts := strings.Fields(message)
 
 	if len(parts) < 3 {
 		// do nothing if we don't have enough information from the message
-		return nil, errors.New("malformed message")
+		return nil, fmt.Errorf("%w: expected x, y and color", errMalformed)
 	}
 
 	x, y, c := parts[0], parts[1], parts[2]
@@ -261,22 +288,22 @@ func createInternalMessage(message string, user User, timestamp time.Time) (*Int
 
 	// convert to integers
 	if xPos, err = strconv.Atoi(x); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errMalformed, err)
 	}
 	if yPos, err = strconv.Atoi(y); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errMalformed, err)
 	}
 	if color, err = strconv.Atoi(c); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errMalformed, err)
 	}
 
 	// check bounds
-	if err = isInBounds(xPos, yPos); err != nil {
+	if err = hub.isInBounds(xPos, yPos); err != nil {
 		return nil, err
 	}
 
-	if _, ok := colorToName[color]; !ok {
-		return nil, errors.New("unknown color int")
+	if !hub.palette.Valid(color) {
+		return nil, fmt.Errorf("%w %d", errUnknownColor, color)
 	}
 
 	internalMessage := &InternalMessage{X: xPos, Y: yPos, Color: color, User: user, Timestamp: timestamp}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// Errors of the REST API. Errors can wrap them to add details, and they're
+// told apart with errors.Is.
+var (
+	errMalformed        = errors.New("malformed request")
+	errOutOfBounds      = errors.New("out of bounds")
+	errUnknownColor     = errors.New("unknown color")
+	errRateLimited      = errors.New("rate limited")
+	errUnauthorized     = errors.New("unauthorized")
+	errNotFound         = errors.New("not found")
+	errMethodNotAllowed = errors.New("method not allowed")
+)
+
+// Error codes of REST API error responses and websocket error messages.
+const (
+	errorCodeMalformed         = "malformed"
+	errorCodeUnknownType       = "unknown_type"
+	errorCodeOutOfBounds       = "out_of_bounds"
+	errorCodeUnknownColor      = "unknown_color"
+	errorCodeRateLimited       = "rate_limited"
+	errorCodeUnauthorized      = "unauthorized"
+	errorCodeNotFound          = "not_found"
+	errorCodeMethodNotAllowed  = "method_not_allowed"
+	errorCodeCanvasDraft       = "canvas_draft"
+	errorCodeCanvasFrozen      = "canvas_frozen"
+	errorCodeCanvasArchived    = "canvas_archived"
+	errorCodeBoardShrink       = "board_shrink"
+	errorCodeInvalidTransition = "invalid_transition"
+	errorCodeNoHistory         = "history_not_recorded"
+	errorCodeInternal          = "internal"
+)
+
+// apiErrors maps the errors the REST API reports to clients to their
+// status and code. Other errors are reported as internal errors.
+var apiErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{errMalformed, http.StatusBadRequest, errorCodeMalformed},
+	{errOutOfBounds, http.StatusBadRequest, errorCodeOutOfBounds},
+	{errUnknownColor, http.StatusBadRequest, errorCodeUnknownColor},
+	{errRateLimited, http.StatusTooEarly, errorCodeRateLimited},
+	{errUnauthorized, http.StatusUnauthorized, errorCodeUnauthorized},
+	{errNotFound, http.StatusNotFound, errorCodeNotFound},
+	{errMethodNotAllowed, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed},
+	{errCanvasDraft, http.StatusForbidden, errorCodeCanvasDraft},
+	{errCanvasFrozen, http.StatusForbidden, errorCodeCanvasFrozen},
+	{errCanvasArchived, http.StatusForbidden, errorCodeCanvasArchived},
+	{errBoardShrink, http.StatusBadRequest, errorCodeBoardShrink},
+	{errInvalidTransition, http.StatusBadRequest, errorCodeInvalidTransition},
+	{errNoHistory, http.StatusNotImplemented, errorCodeNoHistory},
+}
+
+// errorResponse is the body of every REST API error response.
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// RetryAfterMs is set for rate_limited errors.
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"`
+}
+
+// newErrorResponse returns the status and body of the response to err. The
+// messages of internal errors aren't sent, as they may leak details of the
+// server.
+func newErrorResponse(err error) (int, errorResponse) {
+	for _, e := range apiErrors {
+		if errors.Is(err, e.err) {
+			resp := errorResponse{Code: e.code, Message: err.Error()}
+			if wait, ok := retryAfter(err); ok {
+				resp.RetryAfterMs = durationToMs(wait)
+			}
+			return e.status, resp
+		}
+	}
+	return http.StatusInternalServerError, errorResponse{Code: errorCodeInternal, Message: "internal server error"}
+}
+
+// errorCode returns the code of err.
+func errorCode(err error) string {
+	_, resp := newErrorResponse(err)
+	return resp.Code
+}
+
+// writeError logs err and responds with its JSON error body.
+func writeError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	status, body := newErrorResponse(err)
+	resp, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
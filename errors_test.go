@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteError(t *testing.T) {
+	for _, tc := range []struct {
+		err           error
+		status        int
+		code, message string
+		retryAfterMs  int64
+	}{
+		{fmt.Errorf("%w: (9, 9) isn't on the board", errOutOfBounds), http.StatusBadRequest, errorCodeOutOfBounds, "out of bounds: (9, 9) isn't on the board", 0},
+		{errUnknownColor, http.StatusBadRequest, errorCodeUnknownColor, "unknown color", 0},
+		{fmt.Errorf("%w: missing token", errUnauthorized), http.StatusUnauthorized, errorCodeUnauthorized, "unauthorized: missing token", 0},
+		{errCanvasFrozen, http.StatusForbidden, errorCodeCanvasFrozen, "the canvas is frozen", 0},
+		{rateLimitedError{RateLimit{RetryAfter: 1500 * time.Microsecond}}, http.StatusTooEarly, errorCodeRateLimited, "rate limited", 2},
+		{errors.New("dial tcp: connection refused"), http.StatusInternalServerError, errorCodeInternal, "internal server error", 0},
+	} {
+		w := httptest.NewRecorder()
+		writeError(w, tc.err)
+
+		var resp errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("writeError(%v): body %q isn't json: %v", tc.err, w.Body, err)
+		}
+		want := errorResponse{Code: tc.code, Message: tc.message, RetryAfterMs: tc.retryAfterMs}
+		if w.Code != tc.status || resp != want || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("writeError(%v) = %d %+v, want %d %+v", tc.err, w.Code, resp, tc.status, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sseProtocol is the pseudo subprotocol of clients reading the
+// server-sent events stream at /events.
+const sseProtocol = "sse"
+
+// Server-sent event names. Events carry the same payloads as the json
+// websocket protocol, and the id of every event is a sequence number.
+const (
+	// eventPlace is sent when a tile is placed.
+	eventPlace = "place"
+
+	// eventTiles is sent with the whole board when the stream starts and
+	// the placements missed since Last-Event-ID aren't known, and after
+	// the board is resized.
+	eventTiles = "tiles"
+
+	// eventResize is sent with the new size of the board when it's resized.
+	eventResize = "resize"
+)
+
+// encodeEvent formats a server-sent event.
+func encodeEvent(event string, id uint64, payload interface{}) []byte {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		// all payloads are plain structs, so this can't happen
+		panic(err)
+	}
+	return []byte(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", id, event, data))
+}
+
+// serveEvents serves the '/events' route, a text/event-stream of every tile
+// placed. Clients resuming the stream send the id of the last event they
+// saw in the Last-Event-ID header and only get the events they missed, if
+// they're still known.
+func serveEvents(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/events") {
+		return
+	}
+
+	// authenticate with either a browser session or a personal access token
+	if session, err := getSession(r); err != nil || !session.isAuthenticated() {
+		if _, err := authPersonalAccessToken(r); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errors.New("streaming isn't supported"))
+		return
+	}
+
+	since, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	client := &Client{hub: hub, send: make(chan []byte, sendBufferSize), protocol: sseProtocol, since: since}
+	hub.register <- client
+	defer func() {
+		hub.unregister <- client
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// stop proxies like nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				// The hub dropped the client for falling behind.
+				return
+			}
+			w.Write(client.encoded(message))
+
+			// Add queued events to the current write.
+			n := len(client.send)
+			for i := 0; i < n; i++ {
+				w.Write(client.encoded(<-client.send))
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			// comments keep idle connections from being closed by proxies
+			w.Write([]byte(": ping\n\n"))
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readEvent reads a server-sent event, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (id, event, data string) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return id, event, data
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestServeEvents(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hub.run()
+
+	sessions.Set("events-test", Session{User: User{Id: 1, Username: "watcher"}})
+	defer sessions.Delete("events-test")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(hub, w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	get := func(lastEventID string) *bufio.Reader {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: "events-test"})
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Content-Type = %q", ct)
+		}
+		return bufio.NewReader(resp.Body)
+	}
+
+	stream := get("")
+	id, event, _ := readEvent(t, stream)
+	if event != eventTiles {
+		t.Fatalf("first event = %q, want %q", event, eventTiles)
+	}
+
+	hub.broadcast <- &InternalMessage{X: 7, Y: 8, Color: 9, User: User{Username: "painter"}}
+	placeID, event, data := readEvent(t, stream)
+	if event != eventPlace || data != `{"x":7,"y":8,"color":9}` {
+		t.Fatalf("got %s %s, want the placed tile", event, data)
+	}
+	if want := fmt.Sprint(hub.boardVersion()); placeID != want {
+		t.Fatalf("event id = %s, want %s", placeID, want)
+	}
+
+	// resuming from the board gets only the missed placement
+	resumed := get(id)
+	if resumedID, event, _ := readEvent(t, resumed); event != eventPlace || resumedID != placeID {
+		t.Fatalf("resumed with %s %s, want place %s", event, resumedID, placeID)
+	}
+}
@@ -4,15 +4,14 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"html/template"
 	"image"
-	"image/color"
 	"image/png"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
-	"text/template"
 
 	"github.com/google/uuid"
 	"golang.org/x/oauth2"
@@ -23,9 +22,6 @@ var resources embed.FS
 var home = template.Must(template.ParseFS(resources, "home.html"))
 
 var (
-	// sessions stores user session information for browser login
-	sessions = map[string]*Session{}
-
 	oauthConf = &oauth2.Config{
 		RedirectURL:  os.Getenv("OAUTH_REDIRECT"),
 		ClientID:     os.Getenv("OAUTH_CLIENT_ID"),
@@ -38,35 +34,23 @@ var (
 	}
 )
 
-// Each session contains the user information and the oauth state
-// to protect users from CSRF attacks.
-// See https://pkg.go.dev/golang.org/x/oauth2#Config.AuthCodeURL
-type Session struct {
-	User
-	State string
-}
-
-func (s Session) isAuthenticated() bool {
-	return s.Id != 0
-}
-
 // verifyRoute is a helper function to check that a request has the expected
 // method and path.
 func verifyRoute(w http.ResponseWriter, r *http.Request, method, path string) bool {
 	log.Println(r.URL)
 	if r.URL.Path != path {
-		http.Error(w, "Not found", http.StatusNotFound)
+		writeError(w, fmt.Errorf("%w: %s", errNotFound, r.URL.Path))
 		return false
 	}
 	if r.Method != method {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, fmt.Errorf("%w: %s %s", errMethodNotAllowed, r.Method, r.URL.Path))
 		return false
 	}
 	return true
 }
 
 // serveHome serves the '/' route and the main application.
-func serveHome(w http.ResponseWriter, r *http.Request) {
+func serveHome(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	if !verifyRoute(w, r, http.MethodGet, "/") {
 		return
 	}
@@ -76,7 +60,12 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	home.Execute(w, nil)
+	view := hub.view()
+	home.Execute(w, struct {
+		Canvas        string
+		Width, Height int
+		Palette       *Palette
+	}{hub.name, view.width(), view.height(), hub.palette})
 }
 
 // serveLogin serves the '/login' route for initializing the oauth flow.
@@ -95,17 +84,23 @@ func serveLogin(w http.ResponseWriter, r *http.Request) {
 	sessionToken := uuid.NewString()
 
 	// Set the token in the session map, along with the session information
-	sessions[sessionToken] = &Session{
+	session := Session{
 		State: uuid.NewString(),
 	}
+	if err := sessions.Set(sessionToken, session); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
 	// Set the client cookie for "session_token" as the session token
 	http.SetCookie(w, &http.Cookie{
-		Name:  "session_token",
-		Value: sessionToken,
+		Name:   "session_token",
+		Value:  sessionToken,
+		MaxAge: int(sessionTTL.Seconds()),
 	})
 
-	url := oauthConf.AuthCodeURL(sessions[sessionToken].State, oauth2.AccessTypeOnline)
+	url := oauthConf.AuthCodeURL(session.State, oauth2.AccessTypeOnline)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
@@ -170,6 +165,12 @@ func serveAuth(w http.ResponseWriter, r *http.Request) {
 
 	// save user in session
 	session.User = user
+	sessionToken, _ := r.Cookie("session_token")
+	if err := sessions.Set(sessionToken.Value, *session); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
@@ -185,38 +186,28 @@ func serveFavicon(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// favicon should be a multiple of 48 pixels
-	const width, height = 48, 48
-	// TODO: sync this map with the javascript in home.html
-	colorMap := map[int]color.NRGBA{
-		0:  {0x00, 0x00, 0x00, 0xff},
-		1:  {0x00, 0x55, 0x00, 0xff},
-		2:  {0x00, 0xab, 0x00, 0xff},
-		3:  {0x00, 0xff, 0x00, 0xff},
-		4:  {0x00, 0x00, 0xff, 0xff},
-		5:  {0x64, 0x95, 0xed, 0xff},
-		6:  {0x00, 0xab, 0xff, 0xff},
-		7:  {0x00, 0xff, 0xff, 0xff},
-		8:  {0xff, 0x00, 0x00, 0xff},
-		9:  {0xff, 0x55, 0x00, 0xff},
-		10: {0xff, 0xab, 0x00, 0xff},
-		11: {0xff, 0xff, 0x00, 0xff},
-		12: {0xff, 0x00, 0xff, 0xff},
-		13: {0xff, 0x55, 0xff, 0xff},
-		14: {0xff, 0xab, 0xff, 0xff},
-		15: {0xff, 0xff, 0xff, 0xff},
+	// favicon should be a multiple of 48 pixels, unless the board is
+	// smaller than that
+	view := hub.view()
+	boardHeight, boardWidth := view.height(), view.width()
+	width, height := 48, 48
+	if boardWidth < width {
+		width = boardWidth
+	}
+	if boardHeight < height {
+		height = boardHeight
 	}
 
 	// Create a colored image of the given width and height.
 	img := image.NewNRGBA(image.Rect(0, 0, width, height))
 
-	offsetX, offsetY := rand.Intn(100-width), rand.Intn(100-height)
+	offsetX, offsetY := rand.Intn(boardWidth-width+1), rand.Intn(boardHeight-height+1)
 	// set pixels from our board
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
-			colorID := hub.board[offsetX+y][offsetY+x]
+			colorID := view.tiles[offsetY+y][offsetX+x]
 			// map color ID to RGBA
-			img.Set(x, y, colorMap[colorID])
+			img.Set(x, y, hub.palette.NRGBA(colorID))
 		}
 	}
 
@@ -238,11 +229,6 @@ func getSession(r *http.Request) (*Session, error) {
 	}
 	sessionToken := c.Value
 
-	// We then get the session from our session map
-	userSession, exists := sessions[sessionToken]
-	if !exists {
-		return nil, errors.New("Session not found")
-	}
-
-	return userSession, nil
+	// We then get the session from our session store
+	return sessions.Get(sessionToken)
 }
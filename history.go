@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// snapshotInterval is the number of placements between board snapshots.
+// Reconstructing the board at a point in time replays at most this many
+// placements on top of the closest snapshot.
+const snapshotInterval = 1000
+
+// BoardSnapshot is the whole board as it looked at Timestamp, packed the
+// same way as its canvas's BoardStore.
+type BoardSnapshot struct {
+	Timestamp time.Time
+	Width     int
+	Height    int
+	Board     []byte
+}
+
+// saveSnapshot stores a snapshot of the current board. It must only be
+// called from the hub's goroutine.
+func (h *Hub) saveSnapshot(timestamp time.Time) {
+	h.placementsSinceSnapshot = 0
+	view := h.view()
+	snapshot := BoardSnapshot{
+		Timestamp: timestamp,
+		Width:     view.width(),
+		Height:    view.height(),
+		Board:     packBoard(view.tiles, h.tileBits),
+	}
+	if err := h.metadata.AddSnapshot(snapshot); err != nil {
+		log.Println("Failed to save snapshot:", err)
+	}
+}
+
+// boardAt reconstructs the board as it looked at a point in time from the
+// closest earlier snapshot and the placements made since.
+func (h *Hub) boardAt(at time.Time) ([][]int, error) {
+	snapshot, err := h.metadata.GetSnapshot(at)
+	if err != nil {
+		return nil, err
+	}
+
+	var board [][]int
+	var since time.Time
+	if snapshot == nil {
+		view := h.view()
+		board = newBoard(view.width(), view.height(), h.palette.DefaultID())
+	} else {
+		board = unpackBoard(snapshot.Board, snapshot.Width, snapshot.Height, h.tileBits)
+		since = snapshot.Timestamp
+	}
+
+	placements, err := h.metadata.GetPlacements(since, at)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range placements {
+		if p.Y < len(board) && p.X < len(board[p.Y]) {
+			board[p.Y][p.X] = p.Color
+		}
+	}
+	return board, nil
+}
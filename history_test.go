@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoardAt(t *testing.T) {
+	metadata, err := newSQLiteMetadataStore(filepath.Join(t.TempDir(), "rc-place.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metadata.Close()
+
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	place := func(offset time.Duration, x, y, color int) time.Time {
+		message := InternalMessage{X: x, Y: y, Color: color, Timestamp: start.Add(offset)}
+		if _, err := hub.saveAndCreateWebSocketMessage(message); err != nil {
+			t.Fatal(err)
+		}
+		return message.Timestamp
+	}
+
+	first := place(time.Second, 1, 1, 8)
+	second := place(2*time.Second, 1, 1, 3)
+	hub.saveSnapshot(second)
+	third := place(3*time.Second, 2, 1, 0)
+
+	for _, tc := range []struct {
+		name   string
+		at     time.Time
+		tile11 int
+		tile21 int
+	}{
+		{"before any placement", start, defaultColor, defaultColor},
+		{"after the first placement", first, 8, defaultColor},
+		{"at the snapshot", second, 3, defaultColor},
+		{"after the snapshot", third, 3, 0},
+	} {
+		board, err := hub.boardAt(tc.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if board[1][1] != tc.tile11 || board[1][2] != tc.tile21 {
+			t.Errorf("%s: tiles = %d, %d, want %d, %d", tc.name, board[1][1], board[1][2], tc.tile11, tc.tile21)
+		}
+	}
+}
+
+func TestTimelapse(t *testing.T) {
+	metadata, err := newSQLiteMetadataStore(filepath.Join(t.TempDir(), "rc-place.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metadata.Close()
+
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i, color := range []int{8, 3} {
+		message := InternalMessage{X: 0, Y: 0, Color: color, Timestamp: start.Add(time.Duration(i+1) * time.Minute)}
+		if _, err := hub.saveAndCreateWebSocketMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	animation, err := hub.timelapse(start, start.Add(150*time.Second), time.Minute, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// frames at 0s, 60s, 120s and 150s
+	want := []uint8{defaultColor, 8, 3, 3}
+	if len(animation.Image) != len(want) {
+		t.Fatalf("got %d frames, want %d", len(animation.Image), len(want))
+	}
+	for i, frame := range animation.Image {
+		if frame.Bounds().Dx() != 2*defaultBoardSize {
+			t.Fatalf("frame %d is %d pixels wide, want %d", i, frame.Bounds().Dx(), 2*defaultBoardSize)
+		}
+		if got := frame.ColorIndexAt(1, 1); got != want[i] {
+			t.Errorf("frame %d: color = %d, want %d", i, got, want[i])
+		}
+	}
+}
+
+func TestTimelapseSize(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(1000, 1000)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pacCache.set("Bearer timelapse-token", User{Id: 1, Username: "watcher"})
+	t.Cleanup(func() { pacCache.delete("Bearer timelapse-token") })
+
+	for query, want := range map[string]int{
+		// frames wider than an image can be
+		"scale=8&frame-interval=1h": http.StatusBadRequest,
+		// 500 frames of 4000 by 4000 pixels
+		"scale=4": http.StatusBadRequest,
+		// a few frames are fine, but this store has no history to render
+		"scale=4&frame-interval=1h": http.StatusNotImplemented,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/timelapse.gif?from=2022-03-21T00:00:00Z&to=2022-03-21T02:00:00Z&"+query, nil)
+		req.Header.Set("Authorization", "Bearer timelapse-token")
+		w := httptest.NewRecorder()
+		serveTimelapse(hub, w, req)
+		if w.Code != want {
+			t.Errorf("GET /timelapse.gif?%s: got status %d, want %d", query, w.Code, want)
+		}
+	}
+}
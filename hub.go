@@ -1,23 +1,36 @@
 package main
 
 import (
-	"context"
-	"errors"
 	"fmt"
 	"log"
-	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
-
-	"github.com/go-redis/redis/v8"
 )
 
-// boardSize is the width and height of the board, matching the table
-// size in home.html
-const boardSize = 100
+// defaultBoardSize is the width and height of the board when they aren't
+// configured.
+const defaultBoardSize = 100
+
+// maxBoardSize limits the width and height of the board, which are sent to
+// clients as uint16s.
+const maxBoardSize = 1<<16 - 1
 
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
+	// name is the name of the hub's canvas.
+	name string
+
+	// rateLimiter limits how often users can place tiles.
+	rateLimiter RateLimiter
+
+	// palette is the colors tiles can be set to.
+	palette *Palette
+
+	// tileBits is the number of bits each tile is stored in.
+	tileBits int
+
 	// Registered clients.
 	clients map[*Client]bool
 
@@ -30,9 +43,71 @@ type Hub struct {
 	// Unregister requests from clients.
 	unregister chan *Client
 
-	// board is an in-memory representation of the board
-	// where each entry is a javascript color
-	board [][]int
+	// Requests to resize the board.
+	resizes chan resizeRequest
+
+	// Requests to change the canvas's state.
+	stateChanges chan stateRequest
+
+	// Archives written off the hub's goroutine. archiving is set while one
+	// is being written.
+	archives  chan archiveResult
+	archiving bool
+
+	// Changes applied by other instances.
+	remote chan *fanoutMessage
+
+	// broker shares changes with other instances, if there are any.
+	// origin is this instance's ID.
+	broker Broker
+	origin string
+
+	// lastPlaced holds the stamp of the last placement on each tile, to
+	// order placements from different instances. It's only kept when there
+	// is a broker.
+	lastPlaced map[tileKey]placementStamp
+
+	// lifecycle holds the canvasStatus of the canvas. It's only changed
+	// from the hub's goroutine, but read from any.
+	lifecycle atomic.Value
+
+	// board holds the current boardView. It's only changed from the hub's
+	// goroutine, but read from any.
+	board atomic.Value
+
+	// store persists the board.
+	store BoardStore
+
+	// metadata records who last edited each tile and the board's history.
+	metadata TileMetadataStore
+
+	// placementsSinceSnapshot counts placements applied since the last
+	// board snapshot.
+	placementsSinceSnapshot int
+
+	// updates holds the most recently applied placements.
+	updates updateLog
+}
+
+// boardView is the board as of a placement. Views are never changed once
+// they're stored in the hub, so they can be read without locking. Rows that
+// didn't change are shared between views.
+type boardView struct {
+	// tiles holds the color of each tile, by row.
+	tiles [][]int
+
+	// seq is the sequence number of the last placement on the board. It
+	// starts at the time the hub was created, in microseconds, so it keeps
+	// increasing across restarts.
+	seq uint64
+}
+
+func (v boardView) width() int {
+	return len(v.tiles[0])
+}
+
+func (v boardView) height() int {
+	return len(v.tiles)
 }
 
 type InternalMessage struct {
@@ -48,79 +123,146 @@ type TileInfo struct {
 	LastUpdate time.Time
 }
 
-func newHub() *Hub {
-	hub := &Hub{
-		broadcast:  make(chan *InternalMessage),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
-		board:      make([][]int, boardSize),
-	}
-
-	bytes, err := redisClient.Get(context.Background(), os.Getenv("REDIS_BOARD_KEY")).Bytes()
+func newHub(store BoardStore, metadata TileMetadataStore) (*Hub, error) {
+	board, err := store.Load()
 	if err != nil {
-		log.Println(err)
-		if err != redis.Nil {
-			panic(err)
-		}
-		// initialize the bitfield
-		for i := 0; i < boardSize*boardSize; i++ {
-			if err := redisClient.BitField(context.Background(),
-				os.Getenv("REDIS_BOARD_KEY"),
-				"SET",
-				"u4",
-				fmt.Sprintf("#%d", i),
-				5, // 5 is cornflowerblue
-			).Err(); err != nil {
-				panic(err)
-			}
-		}
-		bytes, err = redisClient.Get(context.Background(), os.Getenv("REDIS_BOARD_KEY")).Bytes()
-		if err != nil {
-			panic(err)
-		}
-	}
-
-	// initialize boards
-	for i := 0; i < boardSize; i++ {
-		hub.board[i] = make([]int, boardSize)
+		return nil, err
 	}
 
-	for i := 0; i < len(bytes); i++ {
-		firstColor, secondColor := getColorsFromByte(bytes[i])
-
-		hub.board[i/(boardSize/2)][2*(i%(boardSize/2))] = firstColor
-		hub.board[i/(boardSize/2)][2*(i%(boardSize/2))+1] = secondColor
+	hub := &Hub{
+		name:         defaultCanvas,
+		rateLimiter:  newTokenBucketLimiter(cooldownPolicies(defaultUpdateLimitInMs)),
+		palette:      defaultPalette,
+		tileBits:     store.Layout().bits,
+		broadcast:    make(chan *InternalMessage),
+		register:     make(chan *Client),
+		unregister:   make(chan *Client),
+		resizes:      make(chan resizeRequest),
+		stateChanges: make(chan stateRequest),
+		archives:     make(chan archiveResult),
+		remote:       make(chan *fanoutMessage),
+		lastPlaced:   make(map[tileKey]placementStamp),
+		clients:      make(map[*Client]bool),
+		store:        store,
+		metadata:     metadata,
 	}
+	hub.board.Store(boardView{tiles: board, seq: uint64(time.Now().UnixMicro())})
+	hub.lifecycle.Store(canvasStatus{State: stateOpen})
 
-	return hub
+	// The board may have been changed while history wasn't recorded, so
+	// start from a known state.
+	hub.saveSnapshot(time.Now())
+	return hub, nil
 }
 
 func (h *Hub) run() {
+	schedule := time.NewTicker(scheduleCheckInterval)
+	defer schedule.Stop()
 	for {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			h.syncClient(client)
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.send)
 			}
+		case request := <-h.resizes:
+			request.done <- h.applyResize(request.width, request.height)
+		case request := <-h.stateChanges:
+			h.applyState(request, time.Now())
+		case result := <-h.archives:
+			h.finishArchive(result)
+		case now := <-schedule.C:
+			h.applySchedule(now)
 		case message := <-h.broadcast:
+			// The canvas may have closed since the placement was checked.
+			if err := h.checkOpen(); err != nil {
+				log.Println("Dropping placement:", err)
+				break
+			}
+
+			// Stamp messages in the order they're applied so the placement
+			// log can be replayed by timestamp.
+			message.Timestamp = h.stampPlacement(message.X, message.Y, time.Now())
+
 			// parse and set color in memory
 			webSocketsMessage, err := h.saveAndCreateWebSocketMessage(*message)
 			if err != nil {
 				log.Println(err)
 				break
 			}
-			for client := range h.clients {
-				select {
-				case client.send <- webSocketsMessage:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+			h.recordPlacement(message.X, message.Y, placementStamp{message.Timestamp, h.origin})
+			h.publish(fanoutMessage{InternalMessage: *message})
+
+			h.placementsSinceSnapshot++
+			if h.placementsSinceSnapshot >= snapshotInterval {
+				h.saveSnapshot(message.Timestamp)
 			}
+			h.sendPlacement(*message, webSocketsMessage)
+		case message := <-h.remote:
+			h.applyRemote(message)
+		}
+	}
+}
+
+// applyRemote applies a change made on another instance. Placements are
+// skipped if the tile was placed since, and the other instance already
+// recorded them in the metadata store. It must only be called from the
+// hub's goroutine.
+func (h *Hub) applyRemote(message *fanoutMessage) {
+	if message.Resize != nil {
+		h.applyRemoteResize(*message.Resize)
+		return
+	}
+	if message.State != "" {
+		h.applyRemoteState(message.State)
+		return
+	}
+	if h.archiving || h.status().State == stateArchived {
+		return
+	}
+	if err := h.isInBounds(message.X, message.Y); err != nil {
+		log.Println("Dropping placement from another instance:", err)
+		return
+	}
+	// the other instance may be running with another palette
+	if !h.palette.Valid(message.Color) {
+		log.Println("Dropping placement from another instance:", fmt.Errorf("%w %d", errUnknownColor, message.Color))
+		return
+	}
+	if !h.recordPlacement(message.X, message.Y, placementStamp{message.Timestamp, message.Origin}) {
+		return
+	}
+
+	// the board store may not be shared with the other instance
+	if err := h.store.SetTile(message.X, message.Y, message.Color); err != nil {
+		log.Println(err)
+		return
+	}
+	h.setTile(message.X, message.Y, message.Color)
+	h.sendPlacement(message.InternalMessage, encodeTile(textProtocol, update{InternalMessage: message.InternalMessage}))
+}
+
+// sendPlacement logs a placement applied to the board and sends it to every
+// client. textMessage is the placement encoded for the text protocol. It
+// must only be called from the hub's goroutine.
+func (h *Hub) sendPlacement(message InternalMessage, textMessage []byte) {
+	u := update{Seq: h.view().seq, InternalMessage: message}
+	h.updates.add(u)
+
+	// encode the message once for each protocol in use
+	encoded := map[string][]byte{textProtocol: textMessage}
+	for client := range h.clients {
+		if _, ok := encoded[client.protocol]; !ok {
+			encoded[client.protocol] = encodeTile(client.protocol, u)
+		}
+		select {
+		case client.send <- encoded[client.protocol]:
+		default:
+			close(client.send)
+			delete(h.clients, client)
 		}
 	}
 }
@@ -128,35 +270,79 @@ func (h *Hub) run() {
 // parseAndSave parses a message into x, y, and color and saves it to
 // the board
 func (h *Hub) saveAndCreateWebSocketMessage(message InternalMessage) ([]byte, error) {
-	// update internal boards, user cache
-	h.board[message.Y][message.X] = message.Color
-	lastUpdateCache[message.User.Username] = message.Timestamp
-
-	// update Redis
-	offset := message.Y*boardSize + message.X
-	_, err := redisClient.BitField(context.Background(), os.Getenv("REDIS_BOARD_KEY"), "SET", "u4", fmt.Sprintf("#%d", offset), message.Color).Result()
-	if err != nil {
+	// update board store
+	if err := h.store.SetTile(message.X, message.Y, message.Color); err != nil {
 		return nil, err
 	}
 
-	// update postgres
-	if _, err = postgresClient.Exec(
-		"INSERT INTO tile_info(username, x, y, color) VALUES ($1, $2, $3, $4) ON CONFLICT (x, y) DO UPDATE SET username=excluded.username, timestamp=now(), color=excluded.color",
-		message.User.Username,
-		message.X,
-		message.Y,
-		message.Color); err != nil {
-		// Postgres errors should be non-fatal -- continue executing
+	// update internal board
+	h.setTile(message.X, message.Y, message.Color)
+
+	// update tile metadata and placement log
+	if err := h.metadata.SetTileInfo(message); err != nil {
+		// Metadata errors should be non-fatal -- continue executing
+		log.Println(err)
+	}
+	if err := h.metadata.AddPlacement(message); err != nil {
 		log.Println(err)
 	}
 
 	// return websocket message to be sent on channel
-	return []byte(fmt.Sprintf("%d %d %d\n", message.X, message.Y, message.Color)), nil
+	return encodeTile(textProtocol, update{InternalMessage: message}), nil
+}
+
+// syncClient queues the messages a newly registered client needs to catch
+// up with the board: the placements it missed if it's resuming a session
+// and they're still known, and the whole board otherwise. The board is
+// encoded by the client. It must only be called from the hub's goroutine.
+func (h *Hub) syncClient(client *Client) {
+	view := h.view()
+	if client.since != 0 && client.protocol != textProtocol {
+		var missed []update
+		ok := client.since == view.seq
+		if !ok {
+			missed, ok = h.updates.since(client.since)
+		}
+		if ok && len(missed) < cap(client.send) {
+			for _, u := range missed {
+				client.send <- encodeTile(client.protocol, u)
+			}
+			return
+		}
+	}
+	client.syncView = view
+	client.send <- nil
+}
+
+// view returns the current board.
+func (h *Hub) view() boardView {
+	return h.board.Load().(boardView)
+}
+
+// setTile stores a view of the board with the tile at (x, y) set to color,
+// as the next placement. Only the tile's row is copied. It must only be
+// called from the hub's goroutine.
+func (h *Hub) setTile(x, y, color int) {
+	view := h.view()
+	tiles := make([][]int, len(view.tiles))
+	copy(tiles, view.tiles)
+	row := make([]int, len(tiles[y]))
+	copy(row, tiles[y])
+	row[x] = color
+	tiles[y] = row
+	h.board.Store(boardView{tiles: tiles, seq: view.seq + 1})
+}
+
+// boardVersion returns an identifier that changes whenever the board does.
+func (h *Hub) boardVersion() string {
+	return strconv.FormatUint(h.view().seq, 10)
 }
 
-func isInBounds(x, y int) error {
-	if y < 0 || x < 0 || y >= boardSize || x >= boardSize {
-		return errors.New("out of bounds")
+// isInBounds returns an error if (x, y) isn't a tile of the board.
+func (h *Hub) isInBounds(x, y int) error {
+	view := h.view()
+	if y < 0 || x < 0 || y >= view.height() || x >= view.width() {
+		return fmt.Errorf("%w: (%d, %d) isn't on the board", errOutOfBounds, x, y)
 	}
 	return nil
 }
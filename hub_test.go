@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestBoardViewCopyOnWrite(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := hub.view()
+	hub.setTile(2, 3, 8)
+	after := hub.view()
+	if before.tiles[3][2] == 8 || after.tiles[3][2] != 8 || after.seq != before.seq+1 {
+		t.Fatalf("setTile changed the old view or didn't change the new one")
+	}
+	if &before.tiles[4][0] != &after.tiles[4][0] {
+		t.Errorf("rows that didn't change should be shared between views")
+	}
+}
+
+func TestSyncClientEncodesOffHub(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{hub: hub, send: make(chan []byte, sendBufferSize), protocol: binaryProtocol}
+	hub.syncClient(client)
+	view := hub.view()
+
+	// the board placed after the client registered isn't in its sync
+	hub.setTile(2, 3, 8)
+	message := <-client.send
+	if message != nil {
+		t.Fatalf("syncClient queued %d encoded bytes, want the board to be encoded by the client", len(message))
+	}
+	if got, want := client.encoded(message), encodeSync(binaryProtocol, view.tiles, hub.tileBits, view.seq); !bytes.Equal(got, want) {
+		t.Errorf("client encoded a sync of %d bytes, want the board as of registering", len(got))
+	}
+}
+
+// TestConcurrentPlacementsAndReads places tiles while the board, the token
+// cache and the sessions are read from other goroutines, to be run with
+// -race.
+func TestConcurrentPlacementsAndReads(t *testing.T) {
+	hub, server := newTestServer(t)
+	hub.rateLimiter = newTokenBucketLimiter(cooldownPolicies(0))
+	start := hub.view().seq
+
+	conn := dialTestServer(t, server, "watcher", jsonProtocol)
+	readEnvelope(t, conn)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	pacCache.set("Bearer race-token", User{Id: 1, Username: "race-user"})
+	t.Cleanup(func() { pacCache.delete("Bearer race-token") })
+	sessions.Set("race-test", Session{User: User{Id: 1, Username: "race-user"}})
+	t.Cleanup(func() { sessions.Delete("race-test") })
+
+	const placers, placements = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < placers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := &User{Id: i + 1, Username: fmt.Sprint("placer-", i)}
+			for j := 0; j < placements; j++ {
+				if err := user.SetTile(hub, j, i, "red"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	for _, reader := range []struct {
+		path  string
+		serve func(*Hub, http.ResponseWriter, *http.Request)
+	}{
+		{"/tile?x=1&y=1", serveTile},
+		{"/tiles", getTiles},
+		{"/board.png", serveBoardPNG},
+		{"/favicon.ico", serveFavicon},
+	} {
+		wg.Add(1)
+		go func(path string, serve func(*Hub, http.ResponseWriter, *http.Request)) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				req.Header.Set("Authorization", "Bearer race-token")
+				req.AddCookie(&http.Cookie{Name: "session_token", Value: "race-test"})
+				w := httptest.NewRecorder()
+				serve(hub, w, req)
+				if w.Code != http.StatusOK {
+					t.Errorf("GET %s: got status %d", path, w.Code)
+					return
+				}
+			}
+		}(reader.path, reader.serve)
+	}
+
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 20; j++ {
+			conn.WriteJSON(envelope{Type: messageGetTiles, ID: fmt.Sprint(j)})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			token := fmt.Sprint("race-", j)
+			pacCache.set("Bearer "+token, User{Id: j + 1, Username: token})
+			sessions.Set(token, Session{State: token})
+			pacCache.delete("Bearer " + token)
+			sessions.Delete(token)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := hub.resize(defaultBoardSize+10, defaultBoardSize+10); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	// state changes are handled after every placement sent before them
+	if err := hub.setState(stateOpen); err != nil {
+		t.Fatal(err)
+	}
+	view := hub.view()
+	if want := start + placers*placements + 1; view.seq != want {
+		t.Errorf("seq = %d, want %d", view.seq, want)
+	}
+	red, _ := hub.palette.ID("red")
+	for y := 0; y < placers; y++ {
+		for x := 0; x < placements; x++ {
+			if view.tiles[y][x] != red {
+				t.Fatalf("tile (%d, %d) = %d, want %d", x, y, view.tiles[y][x], red)
+			}
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// canvasState is a stage of a canvas's lifecycle. Tiles can only be placed
+// while the canvas is open, but every state can be viewed and exported.
+type canvasState string
+
+const (
+	// stateDraft is a canvas that hasn't opened yet.
+	stateDraft canvasState = "draft"
+
+	// stateOpen is a canvas accepting placements.
+	stateOpen canvasState = "open"
+
+	// stateFrozen is a canvas that stopped accepting placements, but may be
+	// opened again.
+	stateFrozen canvasState = "frozen"
+
+	// stateArchived is a canvas whose final board was persisted. It can't
+	// be changed anymore.
+	stateArchived canvasState = "archived"
+)
+
+// canvasTransitions lists the states each state can change to.
+var canvasTransitions = map[canvasState][]canvasState{
+	stateDraft:  {stateOpen},
+	stateOpen:   {stateFrozen, stateArchived},
+	stateFrozen: {stateOpen, stateArchived},
+}
+
+// scheduleCheckInterval is how often the hub checks for scheduled state
+// changes.
+const scheduleCheckInterval = time.Second
+
+// Errors returned when a placement is rejected because the canvas isn't
+// open.
+var (
+	errCanvasDraft    = errors.New("the canvas hasn't opened yet")
+	errCanvasFrozen   = errors.New("the canvas is frozen")
+	errCanvasArchived = errors.New("the canvas is archived")
+)
+
+// errInvalidTransition is returned when the canvas can't change to a state
+// from its current state.
+var errInvalidTransition = errors.New("the canvas can't change state")
+
+// canvasStatus is the state of a canvas and its scheduled state changes.
+// OpensAt and ClosesAt are nil once they've happened or if they aren't
+// scheduled.
+type canvasStatus struct {
+	State canvasState `json:"state"`
+
+	// OpensAt is when a draft canvas opens.
+	OpensAt *time.Time `json:"opensAt,omitempty"`
+
+	// ClosesAt is when an open canvas is frozen.
+	ClosesAt *time.Time `json:"closesAt,omitempty"`
+}
+
+// stateRequest asks the hub to change the canvas's state. The result is
+// sent on done. remote is set for changes made by another instance, which
+// aren't published again.
+type stateRequest struct {
+	state  canvasState
+	remote bool
+	done   chan error
+}
+
+// archiveResult is the result of writing the canvas's archive off the
+// hub's goroutine. previous is the status of the canvas before it was
+// archived.
+type archiveResult struct {
+	request  stateRequest
+	previous canvasStatus
+	err      error
+}
+
+// canvasArchive is the final state of an archived canvas.
+type canvasArchive struct {
+	Name       string    `json:"name"`
+	ArchivedAt time.Time `json:"archivedAt"`
+	Seq        uint64    `json:"seq"`
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	Palette    *Palette  `json:"palette"`
+	Tiles      [][]int   `json:"tiles"`
+	tilesMetadata
+}
+
+// isCanvasClosed reports whether err rejected a placement because the
+// canvas isn't open.
+func isCanvasClosed(err error) bool {
+	return errors.Is(err, errCanvasDraft) || errors.Is(err, errCanvasFrozen) || errors.Is(err, errCanvasArchived)
+}
+
+// status returns the canvas's state and scheduled state changes.
+func (h *Hub) status() canvasStatus {
+	return h.lifecycle.Load().(canvasStatus)
+}
+
+// checkOpen returns an error saying why tiles can't be placed if the canvas
+// isn't open.
+func (h *Hub) checkOpen() error {
+	status := h.status()
+	switch status.State {
+	case stateOpen:
+		return nil
+	case stateDraft:
+		if status.OpensAt != nil {
+			return fmt.Errorf("%w, it opens at %s", errCanvasDraft, status.OpensAt.Format(time.RFC3339))
+		}
+		return errCanvasDraft
+	case stateFrozen:
+		return errCanvasFrozen
+	default:
+		return errCanvasArchived
+	}
+}
+
+// setState changes the canvas's state, archiving it when state is
+// stateArchived.
+func (h *Hub) setState(state canvasState) error {
+	request := stateRequest{state: state, done: make(chan error, 1)}
+	h.stateChanges <- request
+	return <-request.done
+}
+
+// applyState changes the canvas's state if the current state allows it, and
+// sends the result on request.done. The archive is written off the hub's
+// goroutine, with the canvas frozen until finishArchive is called with the
+// result. It must only be called from the hub's goroutine.
+func (h *Hub) applyState(request stateRequest, now time.Time) {
+	status := h.status()
+	if h.archiving {
+		request.done <- fmt.Errorf("%w while it's being archived", errInvalidTransition)
+		return
+	}
+	if status.State == request.state {
+		request.done <- nil
+		return
+	}
+	allowed := false
+	for _, next := range canvasTransitions[status.State] {
+		allowed = allowed || next == request.state
+	}
+	if !allowed {
+		request.done <- fmt.Errorf("%w from %s to %s", errInvalidTransition, status.State, request.state)
+		return
+	}
+
+	if request.state == stateArchived {
+		h.archiving = true
+		frozen := status
+		frozen.State = stateFrozen
+		h.lifecycle.Store(frozen)
+		view := h.view()
+		go func() {
+			h.archives <- archiveResult{request: request, previous: status, err: h.archive(view, now)}
+		}()
+		return
+	}
+	status.State = request.state
+	h.lifecycle.Store(status)
+	log.Printf("Canvas %s is now %s\n", h.name, request.state)
+	h.publishState(request)
+	request.done <- nil
+}
+
+// finishArchive archives the canvas once its archive is written, or
+// restores its previous state if it couldn't be. It must only be called
+// from the hub's goroutine.
+func (h *Hub) finishArchive(result archiveResult) {
+	h.archiving = false
+	status := result.previous
+	if result.err == nil {
+		status.State = stateArchived
+		log.Printf("Canvas %s is now %s\n", h.name, stateArchived)
+	}
+	h.lifecycle.Store(status)
+	if result.err == nil {
+		h.publishState(result.request)
+	}
+	result.request.done <- result.err
+}
+
+// publishState has the other instances make a state change made on this
+// one. It must only be called from the hub's goroutine.
+func (h *Hub) publishState(request stateRequest) {
+	if !request.remote {
+		h.publish(fanoutMessage{State: request.state})
+	}
+}
+
+// applySchedule opens or freezes the canvas if it's scheduled to by now. It
+// must only be called from the hub's goroutine, or before it's started.
+func (h *Hub) applySchedule(now time.Time) {
+	status := h.status()
+	if status.State == stateDraft && status.OpensAt != nil && !now.Before(*status.OpensAt) {
+		status.State, status.OpensAt = stateOpen, nil
+		h.lifecycle.Store(status)
+		log.Printf("Canvas %s is now %s\n", h.name, stateOpen)
+	}
+	if status.State == stateOpen && status.ClosesAt != nil && !now.Before(*status.ClosesAt) {
+		status.State, status.ClosesAt = stateFrozen, nil
+		h.lifecycle.Store(status)
+		log.Printf("Canvas %s is now %s\n", h.name, stateFrozen)
+	}
+}
+
+// archivePath returns the path of the canvas's archive file with the given
+// extension, in the directory set by the ARCHIVE_DIR environment variable.
+func archivePath(name, ext string) string {
+	dir := os.Getenv("ARCHIVE_DIR")
+	if dir == "" {
+		dir = "archive"
+	}
+	return filepath.Join(dir, name+ext)
+}
+
+// isArchived reports whether the canvas was archived by a previous run.
+func isArchived(name string) bool {
+	_, err := os.Stat(archivePath(name, ".json"))
+	return err == nil
+}
+
+// archive persists an image of the final board view and the board with
+// its metadata. The json file is written last, as its presence marks the
+// canvas as archived. It's called off the hub's goroutine, as it waits on
+// the metadata store.
+func (h *Hub) archive(view boardView, now time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(archivePath(h.name, "")), 0755); err != nil {
+		return err
+	}
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, renderPaletted(view.tiles, h.palette.ImagePalette(), 1)); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(archivePath(h.name, ".png"), img.Bytes()); err != nil {
+		return err
+	}
+
+	// the archive has to include placements still queued for the database
+	if queued, ok := h.metadata.(metadataFlusher); ok {
+		if err := queued.Flush(); err != nil {
+			return err
+		}
+	}
+	region, err := h.metadata.GetRegionInfo(0, 0, view.width(), view.height())
+	if err != nil {
+		return err
+	}
+	archive, err := json.Marshal(canvasArchive{
+		Name:          h.name,
+		ArchivedAt:    now,
+		Seq:           view.seq,
+		Width:         view.width(),
+		Height:        view.height(),
+		Palette:       h.palette,
+		Tiles:         view.tiles,
+		tilesMetadata: newTilesMetadata(region),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(archivePath(h.name, ".json"), archive)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path,
+// so path is never left partially written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// serveState serves the '/state' route, the canvas's state and scheduled
+// state changes.
+func serveState(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/state") {
+		return
+	}
+
+	resp, err := json.Marshal(hub.status())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// serveSetState serves the '/admin/state' route for opening, freezing and
+// archiving the canvas.
+func serveSetState(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/admin/state") {
+		return
+	}
+
+	// authenticate
+	user, err := authAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	defer r.Body.Close()
+	var body struct {
+		State canvasState `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errMalformed, err))
+		return
+	}
+	if _, ok := canvasTransitions[body.State]; !ok && body.State != stateArchived {
+		writeError(w, fmt.Errorf("%w: unknown canvas state %q", errMalformed, body.State))
+		return
+	}
+
+	if err := hub.setState(body.State); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("%s set canvas %s to %s\n", user.Username, hub.name, body.State)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanvasSchedule(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opensAt := time.Now().Add(time.Hour)
+	closesAt := opensAt.Add(48 * time.Hour)
+	hub.lifecycle.Store(canvasStatus{State: stateDraft, OpensAt: &opensAt, ClosesAt: &closesAt})
+
+	user := &User{Id: 1, Username: "painter"}
+	if err := user.SetTile(hub, 1, 1, "red"); !isCanvasClosed(err) || !strings.Contains(err.Error(), "opens at") {
+		t.Fatalf("SetTile() on a draft canvas = %v, want it to say when the canvas opens", err)
+	}
+
+	hub.applySchedule(opensAt.Add(-time.Second))
+	if state := hub.status().State; state != stateDraft {
+		t.Fatalf("state before opensAt = %s, want %s", state, stateDraft)
+	}
+	hub.applySchedule(opensAt)
+	if status := hub.status(); status.State != stateOpen || status.OpensAt != nil {
+		t.Fatalf("status at opensAt = %+v, want open", status)
+	}
+	if err := hub.checkOpen(); err != nil {
+		t.Fatalf("checkOpen() on an open canvas = %v", err)
+	}
+
+	hub.applySchedule(closesAt.Add(time.Minute))
+	if status := hub.status(); status.State != stateFrozen || status.ClosesAt != nil {
+		t.Fatalf("status after closesAt = %+v, want frozen", status)
+	}
+	if err := user.SetTile(hub, 1, 1, "red"); err != errCanvasFrozen {
+		t.Fatalf("SetTile() on a frozen canvas = %v, want %v", err, errCanvasFrozen)
+	}
+
+	// placing tiles is rejected with the reason, while viewing still works
+	pacCache.set("Bearer lifecycle-token", *user)
+	t.Cleanup(func() { pacCache.delete("Bearer lifecycle-token") })
+	req := httptest.NewRequest(http.MethodPost, "/tile", strings.NewReader(`{"x": 1, "y": 1, "color": "red"}`))
+	req.Header.Set("Authorization", "Bearer lifecycle-token")
+	w := httptest.NewRecorder()
+	serveTile(hub, w, req)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "frozen") {
+		t.Fatalf("POST /tile on a frozen canvas: got %d %s, want %d", w.Code, w.Body, http.StatusForbidden)
+	}
+	w = httptest.NewRecorder()
+	serveBoardPNG(hub, w, httptest.NewRequest(http.MethodGet, "/board.png", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /board.png on a frozen canvas: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestFrozenCanvasProtocol(t *testing.T) {
+	hub, server := newTestServer(t)
+	conn := dialTestServer(t, server, "json-user", jsonProtocol)
+	readEnvelope(t, conn)
+
+	hub.lifecycle.Store(canvasStatus{State: stateFrozen})
+	conn.WriteJSON(envelope{Type: messagePlace, ID: "1", Payload: placePayload{X: 2, Y: 3, Color: 8}})
+	message, payload := readEnvelope(t, conn)
+	var e errorPayload
+	json.Unmarshal(payload, &e)
+	if message.Type != messageError || e.Code != errorCodeCanvasFrozen || e.Message != errCanvasFrozen.Error() {
+		t.Fatalf("reply to a place on a frozen canvas = %s %s, want error %s", message.Type, payload, errorCodeCanvasFrozen)
+	}
+}
+
+func TestArchiveCanvas(t *testing.T) {
+	t.Setenv("ADMIN_USERS", "admin")
+	t.Setenv("ARCHIVE_DIR", t.TempDir())
+	hub, _ := newTestServer(t)
+	hub.name = "batch"
+	hub.broadcast <- &InternalMessage{X: 2, Y: 3, Color: 8, User: User{Username: "painter"}}
+
+	pacCache.set("Bearer admin", User{Id: 1, Username: "admin"})
+	t.Cleanup(func() { pacCache.delete("Bearer admin") })
+	postState := func(state string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/state", strings.NewReader(`{"state": "`+state+`"}`))
+		req.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		serveSetState(hub, w, req)
+		return w
+	}
+
+	if w := postState("melted"); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown state: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := postState(string(stateFrozen)); w.Code != http.StatusOK || hub.status().State != stateFrozen {
+		t.Fatalf("freeze: got status %d and state %s", w.Code, hub.status().State)
+	}
+	if w := postState(string(stateArchived)); w.Code != http.StatusOK || hub.status().State != stateArchived {
+		t.Fatalf("archive: got status %d and state %s", w.Code, hub.status().State)
+	}
+	if w := postState(string(stateOpen)); w.Code != http.StatusBadRequest {
+		t.Fatalf("opening an archived canvas: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if _, err := os.Stat(archivePath("batch", ".png")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(archivePath("batch", ".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive canvasArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if archive.Name != "batch" || archive.Width != defaultBoardSize || archive.Tiles[3][2] != 8 || len(archive.LastEditors) != defaultBoardSize {
+		t.Fatalf("archive of %s is a %dx%d board, want the final board", archive.Name, archive.Width, archive.Height)
+	}
+	if !isArchived("batch") {
+		t.Fatal("isArchived() = false after archiving")
+	}
+}
+
+// blockingFlushStore is a metadata store whose queued writes are written
+// once release is closed, failing with err.
+type blockingFlushStore struct {
+	noopMetadataStore
+	release chan struct{}
+	err     error
+}
+
+func (s *blockingFlushStore) Flush() error {
+	<-s.release
+	return s.err
+}
+
+func TestArchiveOffHubGoroutine(t *testing.T) {
+	t.Setenv("ARCHIVE_DIR", t.TempDir())
+	metadata := &blockingFlushStore{release: make(chan struct{}), err: errors.New("database is down")}
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hub.run()
+
+	archive := func() chan error {
+		done := make(chan error, 1)
+		go func() { done <- hub.setState(stateArchived) }()
+		deadline := time.Now().Add(5 * time.Second)
+		for hub.status().State != stateFrozen {
+			if time.Now().After(deadline) {
+				t.Fatal("the canvas wasn't frozen while archiving")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return done
+	}
+
+	// the hub keeps running while the archive waits on metadata, and the
+	// canvas is opened again if it can't be written
+	done := archive()
+	if err := hub.setState(stateOpen); !errors.Is(err, errInvalidTransition) {
+		t.Fatalf("changing state while archiving: got %v, want errInvalidTransition", err)
+	}
+	metadata.release <- struct{}{}
+	if err := <-done; err == nil || hub.status().State != stateOpen {
+		t.Fatalf("failed archive: got %v and state %s, want an error and the canvas open", err, hub.status().State)
+	}
+
+	metadata.err = nil
+	done = archive()
+	close(metadata.release)
+	if err := <-done; err != nil || hub.status().State != stateArchived {
+		t.Fatalf("archive: got %v and state %s", err, hub.status().State)
+	}
+}
@@ -5,12 +5,17 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var addr = flag.String("addr", ":8080", "http service address")
 
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "reconcile" {
+		os.Exit(runReconcile(flag.Args()[1:]))
+	}
 
 	// check oauth environment variables
 	abort := false
@@ -18,9 +23,6 @@ func main() {
 		"OAUTH_REDIRECT",
 		"OAUTH_CLIENT_ID",
 		"OAUTH_CLIENT_SECRET",
-		"REDIS_HOST",     // TODO: make optional; use map if not provided
-		"REDIS_PASSWORD", // TODO: make optional; use map if not provided
-		"REDIS_BOARD_KEY",
 	} {
 		if _, ok := os.LookupEnv(env); !ok {
 			log.Println("Required environment variable missing:", env)
@@ -32,43 +34,67 @@ func main() {
 		os.Exit(1)
 	}
 
-	// setup postgres connection
-	if err := setupPostgresConnection(); err != nil {
-		log.Println("Error setting up postgres:", err) // TODO make postgres not required
+	// setup tile metadata storage
+	metadata := newTileMetadataStore()
+	defer metadata.Close()
+
+	// write or save queued metadata before exiting
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		log.Println("Shutting down")
+		metadata.Close()
+		os.Exit(0)
+	}()
+
+	// setup fanout between instances
+	broker, err := newBroker()
+	if err != nil {
+		log.Println("Error setting up pub/sub:", err)
+		os.Exit(1)
 	}
-	defer postgresClient.Close()
 
-	// setup redis connection
-	if err := setupRedisClient(); err != nil {
-		log.Println("Error setting up redis:", err)
+	// setup browser sessions
+	if sessions, err = newSessionStore(); err != nil {
+		log.Println("Error setting up sessions:", err)
 		os.Exit(1)
 	}
 
-	hub := newHub()
-	go hub.run()
-	http.HandleFunc("/", serveHome)
-	http.HandleFunc("/login", serveLogin)
-	http.HandleFunc("/auth", serveAuth)
-	http.HandleFunc("/tile", func(w http.ResponseWriter, r *http.Request) {
-		serveTile(hub, w, r)
-	})
-	http.HandleFunc("/tiles", func(w http.ResponseWriter, r *http.Request) {
-		getTiles(hub, w, r)
-	})
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-		serveFavicon(hub, w, r)
-	})
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		session, err := getSession(r)
+	// setup a hub for every canvas
+	configs, err := loadCanvasConfigs()
+	if err != nil {
+		log.Println("Error reading canvases:", err)
+		os.Exit(1)
+	}
+	canvases := canvasRouter{}
+	for _, config := range configs {
+		hub, err := newCanvas(config, metadata)
 		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
-			return
+			log.Printf("Error setting up canvas %s: %v\n", config.Name, err)
+			os.Exit(1)
+		}
+		if broker != nil {
+			if err := hub.subscribe(broker, instanceID); err != nil {
+				log.Printf("Error subscribing canvas %s to other instances: %v\n", config.Name, err)
+				os.Exit(1)
+			}
 		}
-		serveWs(hub, &session.User, w, r)
+		go hub.run()
+		canvases[config.Name] = canvasRoutes(hub)
+	}
+
+	http.HandleFunc("/admin/metadata", func(w http.ResponseWriter, r *http.Request) {
+		serveMetadataStatus(metadata, w, r)
 	})
-	log.Printf("Running on port %s\n", *addr)
+	http.HandleFunc("/login", serveLogin)
+	http.HandleFunc("/auth", serveAuth)
+	http.Handle("/c/", canvases)
+	// the first canvas is also served at the root
+	http.Handle("/", canvases[configs[0].Name])
+	log.Printf("Running instance %s on port %s\n", instanceID, *addr)
 
-	err := http.ListenAndServe(*addr, nil)
+	err = http.ListenAndServe(*addr, nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
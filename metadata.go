@@ -0,0 +1,444 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// TileMetadataStore records who last edited each tile and when, along with
+// an append-only log of every placement. Each canvas's metadata is kept
+// separately.
+type TileMetadataStore interface {
+	// Canvas returns a store for the metadata of the named canvas, sharing
+	// this store's connection. Stores start out with the metadata of the
+	// defaultCanvas.
+	Canvas(name string) TileMetadataStore
+
+	// SetTileInfo records message as the latest edit of its tile.
+	SetTileInfo(message InternalMessage) error
+
+	// GetTileInfo returns the latest edit of the tile at (x, y), or a zero
+	// TileInfo if the tile has never been edited.
+	GetTileInfo(x, y int) (TileInfo, error)
+
+	// GetRegionInfo returns the latest edit of every tile in the width by
+	// height rectangle with its top left tile at (x, y), indexed by row
+	// and then column of the rectangle.
+	GetRegionInfo(x, y, width, height int) ([][]TileInfo, error)
+
+	// GetEditedTiles returns the latest edit of every tile that has been
+	// edited, as placements without an ID.
+	GetEditedTiles() ([]Placement, error)
+
+	// AddPlacement appends message to the placement log.
+	AddPlacement(message InternalMessage) error
+
+	// GetTileHistory returns up to limit placements of the tile at (x, y)
+	// with an ID less than before, newest first.
+	GetTileHistory(x, y int, before int64, limit int) ([]Placement, error)
+
+	// GetPlacements returns the placements made after after and no later
+	// than until, in the order they were applied.
+	GetPlacements(after, until time.Time) ([]Placement, error)
+
+	// AddSnapshot stores a snapshot of the whole board.
+	AddSnapshot(snapshot BoardSnapshot) error
+
+	// GetSnapshot returns the latest snapshot taken no later than at, or
+	// nil if there is none.
+	GetSnapshot(at time.Time) (*BoardSnapshot, error)
+
+	// Close closes the connection shared by every canvas.
+	Close() error
+}
+
+// Placement is an entry in the placement log.
+type Placement struct {
+	ID        int64
+	X         int
+	Y         int
+	Color     int
+	Username  string
+	Timestamp time.Time
+}
+
+// newTileMetadataStore creates the TileMetadataStore selected by the
+// METADATA_STORE environment variable. Valid values are "postgres",
+// "sqlite" and "none". When unset, postgres is used if PG_DATABASE_URL is
+// set and sqlite otherwise. Metadata is not required to run rc-place, so if
+// the selected store can't be set up the error is logged and tile metadata
+// is not recorded.
+func newTileMetadataStore() TileMetadataStore {
+	kind := os.Getenv("METADATA_STORE")
+	if kind == "" {
+		if _, ok := os.LookupEnv("PG_DATABASE_URL"); ok {
+			kind = "postgres"
+		} else {
+			kind = "sqlite"
+		}
+	}
+
+	var store *sqlMetadataStore
+	var err error
+	switch kind {
+	case "postgres":
+		store, err = newPostgresMetadataStore(os.Getenv("PG_DATABASE_URL"))
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "rc-place.db"
+		}
+		store, err = newSQLiteMetadataStore(path)
+	case "none":
+		return noopMetadataStore{}
+	default:
+		err = errors.New("unknown METADATA_STORE: " + kind)
+	}
+	if err != nil {
+		log.Printf("Error setting up %s metadata store, tile metadata will not be recorded: %v\n", kind, err)
+		return noopMetadataStore{}
+	}
+
+	// writes are queued, so placements don't wait on the database
+	async, err := newAsyncMetadataStore(store)
+	if err != nil {
+		log.Printf("Error setting up the metadata queue, tile metadata will not be recorded: %v\n", err)
+		store.Close()
+		return noopMetadataStore{}
+	}
+	return async
+}
+
+// sqlMetadataStore is a TileMetadataStore backed by the tile_info and
+// placements tables. The queries differ between sql dialects.
+type sqlMetadataStore struct {
+	db *sql.DB
+
+	// canvas is the name of the canvas whose metadata is stored. Every
+	// query takes it as its first argument, followed by the arguments
+	// described below.
+	canvas string
+
+	// upsertQuery takes username, x, y, color and timestamp.
+	upsertQuery string
+
+	// selectQuery takes x and y and returns username and timestamp.
+	selectQuery string
+
+	// regionQuery takes the left, right, top and bottom edges of a
+	// rectangle, exclusive of right and bottom, and returns x, y, username
+	// and timestamp.
+	regionQuery string
+
+	// editedTilesQuery returns x, y, username, color and timestamp.
+	editedTilesQuery string
+
+	// insertPlacementQuery takes username, x, y, color and timestamp.
+	insertPlacementQuery string
+
+	// historyQuery takes x, y, before and limit and returns id, username,
+	// color and timestamp.
+	historyQuery string
+
+	// placementsQuery takes after and until and returns id, username, x, y,
+	// color and timestamp.
+	placementsQuery string
+
+	// insertSnapshotQuery takes timestamp, width, height and board.
+	insertSnapshotQuery string
+
+	// snapshotQuery takes at and returns timestamp, width, height and
+	// board.
+	snapshotQuery string
+
+	// placeholder returns the placeholder of the nth argument of a query,
+	// counting from 1.
+	placeholder func(n int) string
+}
+
+// Multi-row statements of WriteBatch, which are the same in every dialect
+// except for their placeholders.
+const (
+	batchUpsertPrefix          = "INSERT INTO tile_info(canvas, username, x, y, color, timestamp) VALUES "
+	batchUpsertSuffix          = " ON CONFLICT (canvas, x, y) DO UPDATE SET username=excluded.username, timestamp=excluded.timestamp, color=excluded.color"
+	batchInsertPlacementPrefix = "INSERT INTO placements(canvas, username, x, y, color, timestamp) VALUES "
+)
+
+// maxBatchRows limits the rows of a single multi-row statement, which keeps
+// its arguments under every dialect's limit.
+const maxBatchRows = 100
+
+func (s *sqlMetadataStore) Canvas(name string) TileMetadataStore {
+	canvas := *s
+	canvas.canvas = name
+	return &canvas
+}
+
+func (s *sqlMetadataStore) SetTileInfo(message InternalMessage) error {
+	_, err := s.db.Exec(s.upsertQuery,
+		s.canvas,
+		message.User.Username,
+		message.X,
+		message.Y,
+		message.Color,
+		message.Timestamp.UTC())
+	return err
+}
+
+func (s *sqlMetadataStore) GetTileInfo(x, y int) (TileInfo, error) {
+	var info TileInfo
+	err := s.db.QueryRow(s.selectQuery, s.canvas, x, y).Scan(&info.User.Username, &info.LastUpdate)
+	if err == sql.ErrNoRows {
+		return TileInfo{}, nil
+	}
+	return info, err
+}
+
+func (s *sqlMetadataStore) GetRegionInfo(x, y, width, height int) ([][]TileInfo, error) {
+	rows, err := s.db.Query(s.regionQuery, s.canvas, x, x+width, y, y+height)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	region := newRegionInfo(width, height)
+	for rows.Next() {
+		var tileX, tileY int
+		var info TileInfo
+		if err := rows.Scan(&tileX, &tileY, &info.User.Username, &info.LastUpdate); err != nil {
+			return nil, err
+		}
+		region[tileY-y][tileX-x] = info
+	}
+	return region, rows.Err()
+}
+
+func (s *sqlMetadataStore) AddPlacement(message InternalMessage) error {
+	_, err := s.db.Exec(s.insertPlacementQuery,
+		s.canvas,
+		message.User.Username,
+		message.X,
+		message.Y,
+		message.Color,
+		message.Timestamp.UTC())
+	return err
+}
+
+func (s *sqlMetadataStore) GetTileHistory(x, y int, before int64, limit int) ([]Placement, error) {
+	rows, err := s.db.Query(s.historyQuery, s.canvas, x, y, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	placements := []Placement{}
+	for rows.Next() {
+		p := Placement{X: x, Y: y}
+		if err := rows.Scan(&p.ID, &p.Username, &p.Color, &p.Timestamp); err != nil {
+			return nil, err
+		}
+		placements = append(placements, p)
+	}
+	return placements, rows.Err()
+}
+
+func (s *sqlMetadataStore) GetEditedTiles() ([]Placement, error) {
+	rows, err := s.db.Query(s.editedTilesQuery, s.canvas)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tiles := []Placement{}
+	for rows.Next() {
+		var p Placement
+		if err := rows.Scan(&p.X, &p.Y, &p.Username, &p.Color, &p.Timestamp); err != nil {
+			return nil, err
+		}
+		tiles = append(tiles, p)
+	}
+	return tiles, rows.Err()
+}
+
+func (s *sqlMetadataStore) GetPlacements(after, until time.Time) ([]Placement, error) {
+	rows, err := s.db.Query(s.placementsQuery, s.canvas, after.UTC(), until.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	placements := []Placement{}
+	for rows.Next() {
+		var p Placement
+		if err := rows.Scan(&p.ID, &p.Username, &p.X, &p.Y, &p.Color, &p.Timestamp); err != nil {
+			return nil, err
+		}
+		placements = append(placements, p)
+	}
+	return placements, rows.Err()
+}
+
+func (s *sqlMetadataStore) AddSnapshot(snapshot BoardSnapshot) error {
+	_, err := s.db.Exec(s.insertSnapshotQuery,
+		s.canvas,
+		snapshot.Timestamp.UTC(),
+		snapshot.Width,
+		snapshot.Height,
+		snapshot.Board)
+	return err
+}
+
+func (s *sqlMetadataStore) GetSnapshot(at time.Time) (*BoardSnapshot, error) {
+	var snapshot BoardSnapshot
+	err := s.db.QueryRow(s.snapshotQuery, s.canvas, at.UTC()).Scan(&snapshot.Timestamp, &snapshot.Width, &snapshot.Height, &snapshot.Board)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func (s *sqlMetadataStore) Close() error {
+	return s.db.Close()
+}
+
+// WriteBatch writes queued metadata of any canvas in a single transaction,
+// with multi-row statements for tile_info and placements.
+func (s *sqlMetadataStore) WriteBatch(batch []metadataWrite) error {
+	// a statement can't update the same tile_info row twice, so only the
+	// latest edit of each tile is written
+	type canvasTile struct {
+		canvas string
+		tileKey
+	}
+	var tileInfos, placements []metadataWrite
+	latest := map[canvasTile]int{}
+	for _, write := range batch {
+		if write.TileInfo != nil {
+			key := canvasTile{write.Canvas, tileKey{write.TileInfo.X, write.TileInfo.Y}}
+			if i, ok := latest[key]; ok {
+				tileInfos[i] = write
+			} else {
+				latest[key] = len(tileInfos)
+				tileInfos = append(tileInfos, write)
+			}
+		}
+		if write.Placement != nil {
+			placements = append(placements, write)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.execRows(tx, batchUpsertPrefix, batchUpsertSuffix, tileInfos, func(w metadataWrite) InternalMessage { return *w.TileInfo }); err != nil {
+		return err
+	}
+	if err := s.execRows(tx, batchInsertPlacementPrefix, "", placements, func(w metadataWrite) InternalMessage { return *w.Placement }); err != nil {
+		return err
+	}
+	for _, write := range batch {
+		if snapshot := write.Snapshot; snapshot != nil {
+			_, err := tx.Exec(s.insertSnapshotQuery, write.Canvas, snapshot.Timestamp.UTC(), snapshot.Width, snapshot.Height, snapshot.Board)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// execRows inserts a row of canvas, username, x, y, color and timestamp for
+// the message of every write, maxBatchRows at a time.
+func (s *sqlMetadataStore) execRows(tx *sql.Tx, prefix, suffix string, writes []metadataWrite, message func(metadataWrite) InternalMessage) error {
+	for len(writes) > 0 {
+		rows := writes
+		if len(rows) > maxBatchRows {
+			rows = rows[:maxBatchRows]
+		}
+		writes = writes[len(rows):]
+
+		var query strings.Builder
+		query.WriteString(prefix)
+		args := make([]interface{}, 0, 6*len(rows))
+		for i, write := range rows {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(")
+			for j := 1; j <= 6; j++ {
+				if j > 1 {
+					query.WriteString(", ")
+				}
+				query.WriteString(s.placeholder(len(args) + j))
+			}
+			query.WriteString(")")
+			m := message(write)
+			args = append(args, write.Canvas, m.User.Username, m.X, m.Y, m.Color, m.Timestamp.UTC())
+		}
+		query.WriteString(suffix)
+		if _, err := tx.Exec(query.String(), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRegionInfo creates a width by height grid of tiles that have never
+// been edited.
+func newRegionInfo(width, height int) [][]TileInfo {
+	region := make([][]TileInfo, height)
+	for i := range region {
+		region[i] = make([]TileInfo, width)
+	}
+	return region
+}
+
+// errNoHistory is returned when the board's history isn't being recorded.
+var errNoHistory = errors.New("board history is not recorded")
+
+// noopMetadataStore discards tile metadata.
+type noopMetadataStore struct{}
+
+func (s noopMetadataStore) Canvas(string) TileMetadataStore { return s }
+
+func (noopMetadataStore) SetTileInfo(InternalMessage) error { return nil }
+
+func (noopMetadataStore) GetTileInfo(int, int) (TileInfo, error) { return TileInfo{}, nil }
+
+func (noopMetadataStore) GetRegionInfo(x, y, width, height int) ([][]TileInfo, error) {
+	return newRegionInfo(width, height), nil
+}
+
+func (noopMetadataStore) GetEditedTiles() ([]Placement, error) { return nil, errNoHistory }
+
+func (noopMetadataStore) AddPlacement(InternalMessage) error { return nil }
+
+func (noopMetadataStore) GetTileHistory(int, int, int64, int) ([]Placement, error) {
+	return []Placement{}, nil
+}
+
+func (noopMetadataStore) GetPlacements(time.Time, time.Time) ([]Placement, error) {
+	return nil, errNoHistory
+}
+
+func (noopMetadataStore) AddSnapshot(BoardSnapshot) error { return nil }
+
+func (noopMetadataStore) GetSnapshot(time.Time) (*BoardSnapshot, error) { return nil, errNoHistory }
+
+func (noopMetadataStore) Close() error { return nil }
+
+// compile time checks that each store implements TileMetadataStore
+var (
+	_ TileMetadataStore = (*sqlMetadataStore)(nil)
+	_ TileMetadataStore = noopMetadataStore{}
+)
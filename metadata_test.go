@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSQLiteMetadataStore(t *testing.T) {
+	store, err := newSQLiteMetadataStore(filepath.Join(t.TempDir(), "rc-place.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	info, err := store.GetTileInfo(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.User.Username != "" || !info.LastUpdate.IsZero() {
+		t.Fatalf("GetTileInfo() = %+v for a tile that was never edited", info)
+	}
+
+	first := time.Date(2022, 3, 21, 12, 0, 0, 0, time.UTC)
+	second := first.Add(time.Minute)
+	for _, message := range []InternalMessage{
+		{X: 1, Y: 2, Color: 8, User: User{Username: "first"}, Timestamp: first},
+		{X: 1, Y: 2, Color: 3, User: User{Username: "second"}, Timestamp: second},
+	} {
+		if err := store.SetTileInfo(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err = store.GetTileInfo(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.User.Username != "second" || !info.LastUpdate.Equal(second) {
+		t.Fatalf("GetTileInfo() = %+v, want the second edit", info)
+	}
+}
+
+func TestSQLiteTileHistory(t *testing.T) {
+	store, err := newSQLiteMetadataStore(filepath.Join(t.TempDir(), "rc-place.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	start := time.Date(2022, 3, 21, 12, 0, 0, 0, time.UTC)
+	for i, color := range []int{1, 2, 3} {
+		message := InternalMessage{X: 4, Y: 5, Color: color, User: User{Username: "painter"}, Timestamp: start.Add(time.Duration(i) * time.Second)}
+		if err := store.AddPlacement(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a placement on another tile shouldn't show up in the history
+	if err := store.AddPlacement(InternalMessage{X: 5, Y: 4, Color: 9, Timestamp: start}); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := store.GetTileHistory(4, 5, math.MaxInt64, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].Color != 3 || page[1].Color != 2 {
+		t.Fatalf("first page = %+v, want colors 3 and 2", page)
+	}
+
+	page, err = store.GetTileHistory(4, 5, page[1].ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Color != 1 || !page[0].Timestamp.Equal(start) {
+		t.Fatalf("second page = %+v, want the first placement", page)
+	}
+}
+
+func TestGetTileHistory(t *testing.T) {
+	store, err := newSQLiteMetadataStore(filepath.Join(t.TempDir(), "rc-place.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2022, 3, 21, 12, 0, 0, 0, time.UTC)
+	for i, color := range []string{"red", "blue", "green"} {
+		id, _ := hub.palette.ID(color)
+		message := InternalMessage{X: 4, Y: 5, Color: id, User: User{Username: "painter"}, Timestamp: start.Add(time.Duration(i) * time.Second)}
+		if err := store.AddPlacement(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pacCache.set("Bearer history-token", User{Id: 1, Username: "history-user"})
+	t.Cleanup(func() { pacCache.delete("Bearer history-token") })
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/tile/history?"+query, nil)
+		req.Header.Set("Authorization", "Bearer history-token")
+		w := httptest.NewRecorder()
+		getTileHistory(hub, w, req)
+		return w
+	}
+	page := func(query string) tileHistoryResponse {
+		w := get(query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d", query, w.Code, http.StatusOK)
+		}
+		var resp tileHistoryResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	first := page("x=4&y=5&limit=2")
+	if first.X != 4 || first.Y != 5 || len(first.Placements) != 2 || first.Placements[0].Color != "green" || first.Placements[1].Color != "blue" {
+		t.Fatalf("first page = %+v, want green and blue", first)
+	}
+	if first.Next != first.Placements[1].ID || first.Placements[0].Editor != "painter" {
+		t.Fatalf("first page = %+v, want next to be the last placement's id", first)
+	}
+	second := page("x=4&y=5&limit=2&before=" + strconv.FormatInt(first.Next, 10))
+	if len(second.Placements) != 1 || second.Placements[0].Color != "red" || !second.Placements[0].Timestamp.Equal(start) || second.Next != 0 {
+		t.Fatalf("second page = %+v, want the first placement and no next", second)
+	}
+	if all := page("x=4&y=5"); len(all.Placements) != 3 || all.Next != 0 {
+		t.Errorf("default page = %+v, want every placement", all)
+	}
+	if empty := page("x=5&y=4"); len(empty.Placements) != 0 {
+		t.Errorf("history of an untouched tile = %+v", empty)
+	}
+
+	for _, query := range []string{"x=4", "x=4&y=five", "x=-1&y=5", "x=4&y=100", "x=4&y=5&limit=0", "x=4&y=5&limit=501", "x=4&y=5&limit=ten", "x=4&y=5&before=soon"} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSQLiteRegionInfo(t *testing.T) {
+	store, err := newSQLiteMetadataStore(filepath.Join(t.TempDir(), "rc-place.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	edited := time.Date(2022, 3, 21, 12, 0, 0, 0, time.UTC)
+	for _, message := range []InternalMessage{
+		{X: 3, Y: 4, Color: 8, User: User{Username: "inside"}, Timestamp: edited},
+		{X: 5, Y: 4, Color: 8, User: User{Username: "outside"}, Timestamp: edited},
+	} {
+		if err := store.SetTileInfo(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	region, err := store.GetRegionInfo(2, 3, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(region) != 2 || len(region[0]) != 3 {
+		t.Fatalf("GetRegionInfo() returned %d rows, want a 3 by 2 region", len(region))
+	}
+	for i, row := range region {
+		for j, info := range row {
+			want := ""
+			if i == 1 && j == 1 {
+				want = "inside"
+			}
+			if info.User.Username != want {
+				t.Errorf("tile (%d, %d) last edited by %q, want %q", 2+j, 3+i, info.User.Username, want)
+			}
+		}
+	}
+	if !region[1][1].LastUpdate.Equal(edited) {
+		t.Errorf("tile (3, 4) last updated %v, want %v", region[1][1].LastUpdate, edited)
+	}
+}
+
+func TestSQLiteCanvases(t *testing.T) {
+	store, err := newSQLiteMetadataStore(filepath.Join(t.TempDir(), "rc-place.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	edited := time.Date(2022, 3, 21, 12, 0, 0, 0, time.UTC)
+	mainCanvas, sandbox := store.Canvas(defaultCanvas), store.Canvas("sandbox")
+	if err := mainCanvas.SetTileInfo(InternalMessage{X: 1, Y: 1, User: User{Username: "main-user"}, Timestamp: edited}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sandbox.SetTileInfo(InternalMessage{X: 1, Y: 1, User: User{Username: "sandbox-user"}, Timestamp: edited}); err != nil {
+		t.Fatal(err)
+	}
+
+	for canvas, want := range map[TileMetadataStore]string{store: "main-user", mainCanvas: "main-user", sandbox: "sandbox-user"} {
+		info, err := canvas.GetTileInfo(1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.User.Username != want {
+			t.Errorf("GetTileInfo() = %q, want %q", info.User.Username, want)
+		}
+	}
+}
+
+func TestSQLiteCanvasMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rc-place.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the schema from before there were multiple canvases
+	for _, statement := range []string{
+		"CREATE TABLE tile_info (username text, timestamp timestamp DEFAULT CURRENT_TIMESTAMP, x int, y int, color int, UNIQUE(x, y))",
+		"CREATE TABLE placements (id integer PRIMARY KEY AUTOINCREMENT, username text, timestamp timestamp, x int, y int, color int)",
+		"INSERT INTO tile_info (username, timestamp, x, y, color) VALUES ('old-user', '2022-03-21 12:00:00', 1, 1, 8)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store, err := newSQLiteMetadataStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	info, err := store.GetTileInfo(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.User.Username != "old-user" {
+		t.Errorf("GetTileInfo() = %q after migrating, want the existing edit", info.User.Username)
+	}
+	// the same tile can now be edited on another canvas
+	if err := store.Canvas("sandbox").SetTileInfo(InternalMessage{X: 1, Y: 1, User: User{Username: "sandbox-user"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddPlacement(InternalMessage{X: 1, Y: 1, User: User{Username: "new-user"}}); err != nil {
+		t.Fatal(err)
+	}
+}
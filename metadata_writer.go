@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// metadataBatchSize limits the writes in a single transaction.
+	metadataBatchSize = 500
+
+	// defaultMetadataQueueSize is the number of writes held in memory when
+	// METADATA_QUEUE_SIZE isn't set.
+	defaultMetadataQueueSize = 100000
+
+	// Failed batches are retried after minMetadataRetry, doubling up to
+	// maxMetadataRetry while they keep failing.
+	minMetadataRetry = 100 * time.Millisecond
+	maxMetadataRetry = 30 * time.Second
+)
+
+// metadataWrite is a queued write of a canvas's metadata. One of TileInfo,
+// Placement and Snapshot is set.
+type metadataWrite struct {
+	Canvas    string           `json:"canvas"`
+	TileInfo  *InternalMessage `json:"tileInfo,omitempty"`
+	Placement *InternalMessage `json:"placement,omitempty"`
+	Snapshot  *BoardSnapshot   `json:"snapshot,omitempty"`
+
+	// Queued is when the write was queued, to report the writer's lag.
+	Queued time.Time `json:"queued"`
+}
+
+// batchWriter writes queued metadata of any canvas.
+type batchWriter interface {
+	WriteBatch(batch []metadataWrite) error
+}
+
+// metadataWriterStatus reports how far behind the metadata writer is.
+type metadataWriterStatus struct {
+	// Pending is the number of writes waiting, in memory and on disk.
+	Pending int `json:"pending"`
+
+	// Spilled is the number of pending writes on disk.
+	Spilled int `json:"spilled"`
+
+	// Dropped is the number of writes lost because the queue was full.
+	Dropped uint64 `json:"dropped"`
+
+	// LagMs is the age of the oldest pending write in memory.
+	LagMs int64 `json:"lagMs"`
+
+	// LastError is the error of the last batch if it failed.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// metadataQueue holds metadata writes until they're written, oldest first.
+// Up to limit writes are held in memory. Once that's full, writes go to the
+// spill file if there is one, and the oldest writes are dropped otherwise.
+// Spilled writes are only read back once the ones in memory are written, so
+// writes stay in order.
+type metadataQueue struct {
+	mu    sync.Mutex
+	limit int
+	spill *spillFile
+
+	// memory holds the oldest writes. The first inflight of them are being
+	// written.
+	memory   []metadataWrite
+	inflight int
+
+	// pushed counts the writes ever queued, and written and dropped the
+	// ones that left the queue, which are always the oldest.
+	pushed  uint64
+	written uint64
+	dropped uint64
+
+	// ready is signaled when writes are pushed.
+	ready chan struct{}
+}
+
+func newMetadataQueue(limit int, spill *spillFile) *metadataQueue {
+	q := &metadataQueue{limit: limit, spill: spill, ready: make(chan struct{}, 1)}
+	if spill != nil {
+		q.pushed = uint64(spill.pending())
+	}
+	return q
+}
+
+// push queues a write without waiting for it to be written.
+func (q *metadataQueue) push(write metadataWrite) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer func() {
+		select {
+		case q.ready <- struct{}{}:
+		default:
+		}
+	}()
+
+	q.pushed++
+	switch {
+	case q.spill == nil || q.spill.pending() == 0 && len(q.memory) < q.limit:
+		if len(q.memory) >= q.limit {
+			q.dropOldest()
+			if len(q.memory) >= q.limit {
+				return
+			}
+		}
+		q.memory = append(q.memory, write)
+	default:
+		if err := q.spill.append(write); err != nil {
+			log.Println("Dropping metadata write:", err)
+			q.dropped++
+		}
+	}
+}
+
+// dropOldest drops the oldest write that isn't being written.
+func (q *metadataQueue) dropOldest() {
+	q.dropped++
+	if q.dropped == 1 || q.dropped%1000 == 0 {
+		log.Printf("Metadata queue is full, %d writes dropped\n", q.dropped)
+	}
+	if q.inflight < len(q.memory) {
+		q.memory = append(q.memory[:q.inflight], q.memory[q.inflight+1:]...)
+	}
+}
+
+// peek returns up to n of the oldest writes, which are removed once ack is
+// called. Spilled writes are read back once the memory is empty. They're
+// read without holding the lock, so push doesn't wait on the disk.
+func (q *metadataQueue) peek(n int) []metadataWrite {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.memory) == 0 && q.spill != nil && q.spill.pending() > 0 {
+		// writes are pushed to the spill file until the ones read back
+		// are taken from it, so they stay in order
+		q.mu.Unlock()
+		writes, malformed, err := q.spill.take(q.limit)
+		q.mu.Lock()
+		if err != nil {
+			log.Println("Failed to read spilled metadata writes:", err)
+		}
+		q.memory = append(writes, q.memory...)
+		q.dropped += uint64(malformed)
+	}
+	if n > len(q.memory) {
+		n = len(q.memory)
+	}
+	q.inflight = n
+	batch := make([]metadataWrite, n)
+	copy(batch, q.memory)
+	return batch
+}
+
+// ack removes the writes returned by the last peek.
+func (q *metadataQueue) ack() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.memory = q.memory[q.inflight:]
+	q.written += uint64(q.inflight)
+	q.inflight = 0
+	if len(q.memory) == 0 {
+		q.memory = nil
+	}
+}
+
+// progress returns the number of writes ever queued, and of the oldest of
+// them that were written or dropped since.
+func (q *metadataQueue) progress() (pushed, done uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pushed, q.written + q.dropped
+}
+
+// status returns the size of the queue and the age of its oldest write.
+func (q *metadataQueue) status(now time.Time) metadataWriterStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := metadataWriterStatus{Pending: len(q.memory), Dropped: q.dropped}
+	if q.spill != nil {
+		status.Spilled = q.spill.pending()
+		status.Pending += status.Spilled
+	}
+	if len(q.memory) > 0 {
+		status.LagMs = durationToMs(now.Sub(q.memory[0].Queued))
+	}
+	return status
+}
+
+// close saves the writes left in memory to the front of the spill file, so
+// they're written after a restart.
+func (q *metadataQueue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.spill == nil {
+		if len(q.memory) > 0 {
+			log.Printf("Dropping %d metadata writes that weren't written\n", len(q.memory))
+		}
+		return nil
+	}
+	if err := q.spill.prepend(q.memory); err != nil {
+		return err
+	}
+	q.memory = nil
+	return q.spill.close()
+}
+
+// spillFile holds metadata writes that don't fit in memory as json lines.
+// Writes are appended to the end of the file and read back from offset,
+// which is saved next to it, so writes that were spilled before a restart
+// and not read back yet are written after it. The file is emptied whenever
+// every write in it was read back.
+type spillFile struct {
+	path string
+
+	// mu guards file, count and offset. Writes are read back from reader
+	// without it, so they can be appended in the meantime.
+	mu     sync.Mutex
+	file   *os.File
+	count  int
+	offset int64
+
+	// reader reads the file from offset. It's only used by the queue's
+	// writer.
+	readFile *os.File
+	reader   *bufio.Reader
+}
+
+// openSpillFile opens the spill file at path, creating it if it doesn't
+// exist.
+func openSpillFile(path string) (*spillFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	readFile, err := os.Open(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s := &spillFile{path: path, file: file, readFile: readFile}
+	if err := s.load(); err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.count > 0 {
+		log.Printf("Found %d spilled metadata writes in %s\n", s.count, path)
+	}
+	return s, nil
+}
+
+// load counts the writes after the saved offset, and positions the reader
+// at the first of them. The file is read from the start if the offset
+// isn't saved or doesn't fit in the file.
+func (s *spillFile) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if saved, err := os.ReadFile(s.offsetPath()); err == nil {
+		offset, err := strconv.ParseInt(string(saved), 10, 64)
+		if err == nil && offset >= 0 && offset <= info.Size() {
+			s.offset = offset
+		}
+	}
+
+	if _, err := s.readFile.Seek(s.offset, io.SeekStart); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(s.readFile)
+	scanner.Buffer(nil, maxSpillLine)
+	for scanner.Scan() {
+		s.count++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if _, err := s.readFile.Seek(s.offset, io.SeekStart); err != nil {
+		return err
+	}
+	s.reader = bufio.NewReader(s.readFile)
+	return nil
+}
+
+// maxSpillLine limits the size of a spilled write, which is mostly the
+// size of a packed board snapshot.
+const maxSpillLine = 1 << 26
+
+func (s *spillFile) offsetPath() string {
+	return s.path + ".offset"
+}
+
+// pending returns the number of writes that weren't read back yet.
+func (s *spillFile) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+func (s *spillFile) append(write metadataWrite) error {
+	line, err := json.Marshal(write)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+// take reads back and returns up to n of the oldest writes, along with the
+// number of malformed writes it dropped. Only the writes that were pending
+// when it was called are read, so it never reads a partly appended line.
+func (s *spillFile) take(n int) (writes []metadataWrite, malformed int, err error) {
+	if pending := s.pending(); n > pending {
+		n = pending
+	}
+	lines, read := 0, int64(0)
+	var readErr error
+	for ; lines < n; lines++ {
+		var line []byte
+		if line, readErr = s.reader.ReadBytes('\n'); readErr != nil {
+			break
+		}
+		read += int64(len(line))
+		var write metadataWrite
+		if err := json.Unmarshal(line, &write); err != nil {
+			log.Println("Dropping malformed spilled metadata write:", err)
+			malformed++
+			continue
+		}
+		writes = append(writes, write)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count -= lines
+	s.offset += read
+	if readErr != nil {
+		err = fmt.Errorf("read %d of %d spilled writes: %w", lines, n, readErr)
+	}
+	if s.count == 0 {
+		// nothing was appended since the writes read back, so the file
+		// can start over
+		if err := s.file.Truncate(0); err != nil {
+			return writes, malformed, err
+		}
+		if _, err := s.readFile.Seek(0, io.SeekStart); err != nil {
+			return writes, malformed, err
+		}
+		s.reader.Reset(s.readFile)
+		s.offset = 0
+	}
+	if saveErr := s.saveOffset(); err == nil {
+		err = saveErr
+	}
+	return writes, malformed, err
+}
+
+func (s *spillFile) saveOffset() error {
+	return writeFileAtomic(s.offsetPath(), []byte(strconv.FormatInt(s.offset, 10)))
+}
+
+// prepend adds writes before the ones that weren't read back, replacing the
+// file. It's only used when the queue is closed, as it copies the file.
+func (s *spillFile) prepend(writes []metadataWrite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+
+	out := bufio.NewWriter(tmp)
+	count := 0
+	for _, write := range writes {
+		line, err := json.Marshal(write)
+		if err != nil {
+			return err
+		}
+		out.Write(append(line, '\n'))
+		count++
+	}
+	scanner := bufio.NewScanner(s.reader)
+	scanner.Buffer(nil, maxSpillLine)
+	for scanner.Scan() {
+		out.Write(append(scanner.Bytes(), '\n'))
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	readFile, err := os.Open(s.path)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file.Close()
+	s.readFile.Close()
+	s.file, s.readFile, s.count, s.offset = file, readFile, count, 0
+	s.reader.Reset(readFile)
+	return s.saveOffset()
+}
+
+func (s *spillFile) close() error {
+	s.readFile.Close()
+	return s.file.Close()
+}
+
+// metadataWriter writes queued metadata in batches from its own goroutine,
+// retrying failed batches until they're written.
+type metadataWriter struct {
+	queue *metadataQueue
+	store batchWriter
+
+	mu      sync.Mutex
+	lastErr error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newMetadataWriter starts writing the writes pushed to queue to store.
+func newMetadataWriter(store batchWriter, queue *metadataQueue) *metadataWriter {
+	w := &metadataWriter{queue: queue, store: store, stop: make(chan struct{}), done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+func (w *metadataWriter) run() {
+	defer close(w.done)
+	retry := minMetadataRetry
+	for {
+		batch := w.queue.peek(metadataBatchSize)
+		if len(batch) == 0 {
+			select {
+			case <-w.queue.ready:
+				continue
+			case <-w.stop:
+				return
+			}
+		}
+
+		err := w.store.WriteBatch(batch)
+		w.mu.Lock()
+		w.lastErr = err
+		w.mu.Unlock()
+		if err == nil {
+			w.queue.ack()
+			retry = minMetadataRetry
+			continue
+		}
+
+		log.Printf("Failed to write metadata, retrying in %v with %d writes queued: %v\n", retry, w.queue.status(time.Now()).Pending, err)
+		select {
+		case <-time.After(retry):
+		case <-w.stop:
+			return
+		}
+		if retry *= 2; retry > maxMetadataRetry {
+			retry = maxMetadataRetry
+		}
+	}
+}
+
+// status reports how far behind the writer is.
+func (w *metadataWriter) status() metadataWriterStatus {
+	status := w.queue.status(time.Now())
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.lastErr != nil {
+		status.LastError = w.lastErr.Error()
+	}
+	return status
+}
+
+// flush waits until the writes queued before it was called are written,
+// or returns the error of the last batch if it failed. Writes queued by
+// other canvases in the meantime aren't waited for.
+func (w *metadataWriter) flush() error {
+	target, _ := w.queue.progress()
+	for {
+		if _, done := w.queue.progress(); done >= target {
+			return nil
+		}
+		w.mu.Lock()
+		err := w.lastErr
+		w.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("%d metadata writes are pending: %w", w.queue.status(time.Now()).Pending, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// close stops the writer after trying to write the queued writes once, and
+// keeps the ones it couldn't write in the spill file.
+func (w *metadataWriter) close() error {
+	close(w.stop)
+	<-w.done
+	for batch := w.queue.peek(metadataBatchSize); len(batch) > 0; batch = w.queue.peek(metadataBatchSize) {
+		if err := w.store.WriteBatch(batch); err != nil {
+			log.Println("Failed to write metadata before closing:", err)
+			break
+		}
+		w.queue.ack()
+	}
+	return w.queue.close()
+}
+
+// metadataFlusher is implemented by metadata stores that queue writes.
+type metadataFlusher interface {
+	// Flush waits until the writes queued before it was called are
+	// written.
+	Flush() error
+}
+
+// asyncMetadataStore is a TileMetadataStore queueing its writes for a
+// metadataWriter, so placements never wait on the database. Reads go to
+// the database and may not include the latest writes yet.
+type asyncMetadataStore struct {
+	*sqlMetadataStore
+	writer *metadataWriter
+}
+
+// newAsyncMetadataStore queues the writes of store. The queue holds up to
+// METADATA_QUEUE_SIZE writes in memory, and the rest in the file at
+// METADATA_QUEUE_FILE if it's set.
+func newAsyncMetadataStore(store *sqlMetadataStore) (*asyncMetadataStore, error) {
+	limit := defaultMetadataQueueSize
+	if size := os.Getenv("METADATA_QUEUE_SIZE"); size != "" {
+		var err error
+		if limit, err = strconv.Atoi(size); err != nil || limit < 1 {
+			return nil, fmt.Errorf("METADATA_QUEUE_SIZE must be a positive integer, got %q", size)
+		}
+	}
+
+	var spill *spillFile
+	if path := os.Getenv("METADATA_QUEUE_FILE"); path != "" {
+		var err error
+		if spill, err = openSpillFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return &asyncMetadataStore{store, newMetadataWriter(store, newMetadataQueue(limit, spill))}, nil
+}
+
+func (s *asyncMetadataStore) Canvas(name string) TileMetadataStore {
+	return &asyncMetadataStore{s.sqlMetadataStore.Canvas(name).(*sqlMetadataStore), s.writer}
+}
+
+func (s *asyncMetadataStore) SetTileInfo(message InternalMessage) error {
+	s.writer.queue.push(metadataWrite{Canvas: s.canvas, TileInfo: &message, Queued: time.Now()})
+	return nil
+}
+
+func (s *asyncMetadataStore) AddPlacement(message InternalMessage) error {
+	s.writer.queue.push(metadataWrite{Canvas: s.canvas, Placement: &message, Queued: time.Now()})
+	return nil
+}
+
+func (s *asyncMetadataStore) AddSnapshot(snapshot BoardSnapshot) error {
+	s.writer.queue.push(metadataWrite{Canvas: s.canvas, Snapshot: &snapshot, Queued: time.Now()})
+	return nil
+}
+
+func (s *asyncMetadataStore) Flush() error {
+	return s.writer.flush()
+}
+
+func (s *asyncMetadataStore) Close() error {
+	if err := s.writer.close(); err != nil {
+		log.Println("Failed to save queued metadata writes:", err)
+	}
+	return s.sqlMetadataStore.Close()
+}
+
+// serveMetadataStatus serves the '/admin/metadata' route, how far behind
+// the metadata writer is.
+func serveMetadataStatus(metadata TileMetadataStore, w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/admin/metadata") {
+		return
+	}
+	if _, err := authAdmin(r); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var status metadataWriterStatus
+	if async, ok := metadata.(*asyncMetadataStore); ok {
+		status = async.writer.status()
+	}
+	resp, err := json.Marshal(status)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
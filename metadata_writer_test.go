@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSQLiteWriteBatch(t *testing.T) {
+	store, err := newSQLiteMetadataStore(filepath.Join(t.TempDir(), "rc-place.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// more rows than fit in a single statement, with repeated tiles
+	start := time.Date(2022, 3, 21, 12, 0, 0, 0, time.UTC)
+	var batch []metadataWrite
+	for i := 0; i < maxBatchRows*2+1; i++ {
+		message := InternalMessage{X: i % 3, Y: 0, Color: i % 8, User: User{Username: "painter"}, Timestamp: start.Add(time.Duration(i) * time.Second)}
+		batch = append(batch, metadataWrite{Canvas: defaultCanvas, TileInfo: &message}, metadataWrite{Canvas: defaultCanvas, Placement: &message})
+	}
+	other := InternalMessage{X: 0, Y: 0, Color: 9, User: User{Username: "other"}, Timestamp: start}
+	batch = append(batch, metadataWrite{Canvas: "other", TileInfo: &other})
+	batch = append(batch, metadataWrite{Canvas: defaultCanvas, Snapshot: &BoardSnapshot{Timestamp: start, Width: 1, Height: 1, Board: []byte{1}}})
+	if err := store.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	last := maxBatchRows * 2
+	info, err := store.GetTileInfo(last%3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.LastUpdate.Equal(start.Add(time.Duration(last) * time.Second)) {
+		t.Errorf("GetTileInfo() = %+v, want the last edit", info)
+	}
+	if info, _ := store.Canvas("other").GetTileInfo(0, 0); info.User.Username != "other" {
+		t.Errorf("GetTileInfo() of the other canvas = %+v", info)
+	}
+	history, err := store.GetTileHistory(0, 0, math.MaxInt64, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := last/3 + 1; len(history) != want {
+		t.Errorf("got %d placements of (0, 0), want %d", len(history), want)
+	}
+	if snapshot, err := store.GetSnapshot(start); err != nil || snapshot == nil || snapshot.Width != 1 {
+		t.Errorf("GetSnapshot() = %+v, %v", snapshot, err)
+	}
+}
+
+// flakyBatchWriter records the batches it's given and fails them while
+// it's down.
+type flakyBatchWriter struct {
+	mu      sync.Mutex
+	down    bool
+	batches [][]metadataWrite
+}
+
+func (f *flakyBatchWriter) WriteBatch(batch []metadataWrite) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errors.New("database is down")
+	}
+	f.batches = append(f.batches, batch)
+	return nil
+}
+
+func (f *flakyBatchWriter) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+// written returns the colors of the placements written, in order.
+func (f *flakyBatchWriter) written() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var colors []int
+	for _, batch := range f.batches {
+		for _, write := range batch {
+			colors = append(colors, write.Placement.Color)
+		}
+	}
+	return colors
+}
+
+func placementWrite(color int) metadataWrite {
+	return metadataWrite{Canvas: defaultCanvas, Placement: &InternalMessage{Color: color}, Queued: time.Now()}
+}
+
+func TestMetadataWriterOutage(t *testing.T) {
+	store := &flakyBatchWriter{down: true}
+	writer := newMetadataWriter(store, newMetadataQueue(defaultMetadataQueueSize, nil))
+	defer writer.close()
+
+	const writes = metadataBatchSize + 10
+	for i := 0; i < writes; i++ {
+		writer.queue.push(placementWrite(i))
+	}
+	if err := writer.flush(); err == nil {
+		t.Fatal("flush while the database is down: want an error")
+	}
+	status := writer.status()
+	if status.Pending != writes || status.LastError == "" {
+		t.Fatalf("status() = %+v, want %d pending writes and the error", status, writes)
+	}
+
+	store.setDown(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for writer.flush() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("queued writes weren't written after the database came back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := writer.status(); status.Pending != 0 || status.LastError != "" {
+		t.Errorf("status() = %+v after writing everything", status)
+	}
+	written := store.written()
+	if len(written) != writes {
+		t.Fatalf("wrote %d writes, want %d", len(written), writes)
+	}
+	for i, color := range written {
+		if color != i {
+			t.Fatalf("write %d was %d, want writes in order", i, color)
+		}
+	}
+	for _, batch := range store.batches {
+		if len(batch) > metadataBatchSize {
+			t.Errorf("batch of %d writes, want at most %d", len(batch), metadataBatchSize)
+		}
+	}
+}
+
+func TestMetadataQueueSpill(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	spill, err := openSpillFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := newMetadataQueue(2, spill)
+	for i := 0; i < 5; i++ {
+		queue.push(placementWrite(i))
+	}
+	if status := queue.status(time.Now()); status.Pending != 5 || status.Spilled != 3 || status.Dropped != 0 {
+		t.Fatalf("status() = %+v, want 3 of 5 writes spilled", status)
+	}
+
+	// spilled writes come after the ones in memory, and writes pushed
+	// while some are spilled come after those
+	if batch := queue.peek(10); len(batch) != 2 || batch[0].Placement.Color != 0 {
+		t.Fatalf("peek() = %+v, want the writes in memory", batch)
+	}
+	queue.ack()
+	queue.push(placementWrite(5))
+	if batch := queue.peek(1); len(batch) != 1 || batch[0].Placement.Color != 2 {
+		t.Fatalf("peek() = %+v, want the first spilled write", batch)
+	}
+	queue.ack()
+
+	// writes left when the queue is closed are found after a restart
+	if err := queue.close(); err != nil {
+		t.Fatal(err)
+	}
+	spill, err = openSpillFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue = newMetadataQueue(2, spill)
+	defer queue.close()
+	var colors []int
+	for batch := queue.peek(10); len(batch) > 0; batch = queue.peek(10) {
+		for _, write := range batch {
+			colors = append(colors, write.Placement.Color)
+		}
+		queue.ack()
+	}
+	if len(colors) != 3 || colors[0] != 3 || colors[1] != 4 || colors[2] != 5 {
+		t.Errorf("got writes %v after a restart, want [3 4 5]", colors)
+	}
+}
+
+func TestMetadataQueueSpillOffset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	spill, err := openSpillFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := newMetadataQueue(2, spill)
+	for i := 0; i < 6; i++ {
+		queue.push(placementWrite(i))
+	}
+	queue.peek(10)
+	queue.ack()
+	if batch := queue.peek(10); len(batch) != 2 || batch[0].Placement.Color != 2 {
+		t.Fatalf("peek() = %+v, want the first spilled writes", batch)
+	}
+
+	// writes read back aren't read again if the process stops without
+	// closing the queue
+	crashed, err := openSpillFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch, _, err := crashed.take(10); err != nil || len(batch) != 2 || batch[0].Placement.Color != 4 {
+		t.Fatalf("take() after a restart = %+v, %v, want the writes that weren't read back", batch, err)
+	}
+	crashed.close()
+
+	// the file starts over once every write was read back
+	queue.ack()
+	if batch := queue.peek(10); len(batch) != 2 || batch[1].Placement.Color != 5 {
+		t.Fatalf("peek() = %+v, want the last spilled writes", batch)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Fatalf("spill file after reading every write: %v, %v, want it empty", info.Size(), err)
+	}
+	queue.ack()
+	queue.push(placementWrite(6))
+	queue.push(placementWrite(7))
+	queue.push(placementWrite(8))
+	if status := queue.status(time.Now()); status.Pending != 3 || status.Spilled != 1 {
+		t.Fatalf("status() = %+v, want 1 of 3 writes spilled", status)
+	}
+	if err := queue.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetadataQueueDropsOldest(t *testing.T) {
+	queue := newMetadataQueue(2, nil)
+	for i := 0; i < 3; i++ {
+		queue.push(placementWrite(i))
+	}
+	if status := queue.status(time.Now()); status.Pending != 2 || status.Dropped != 1 {
+		t.Fatalf("status() = %+v, want 2 pending and 1 dropped", status)
+	}
+	if batch := queue.peek(10); len(batch) != 2 || batch[0].Placement.Color != 1 {
+		t.Errorf("peek() = %+v, want the newest writes", batch)
+	}
+}
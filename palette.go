@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"net/http"
+	"strings"
+)
+
+// maxPaletteSize is the most colors a palette can have, as colors are
+// stored in at most a byte.
+const maxPaletteSize = 256
+
+// PaletteColor is a color tiles can be set to.
+type PaletteColor struct {
+	Name string `json:"name"`
+
+	// RGB is the color in hex, e.g. "#6495ed".
+	RGB string `json:"rgb"`
+}
+
+// Palette is the list of colors of a canvas. Tiles store the index of
+// their color in the list, which is also the color's ID in the API.
+type Palette struct {
+	Colors []PaletteColor `json:"colors"`
+
+	// Default is the name of the color of tiles that were never set. It
+	// defaults to the first color.
+	Default string `json:"default"`
+
+	ids       map[string]int
+	rgba      []color.NRGBA
+	defaultID int
+}
+
+// defaultPalette is the palette of canvases that don't configure one.
+var defaultPalette = mustPalette(&Palette{
+	Colors: []PaletteColor{
+		{"black", "#000000"},
+		{"forest", "#005500"},
+		{"green", "#00ab00"},
+		{"lime", "#00ff00"},
+		{"blue", "#0000ff"},
+		{"cornflowerblue", "#6495ed"},
+		{"sky", "#00abff"},
+		{"cyan", "#00ffff"},
+		{"red", "#ff0000"},
+		{"burnt-orange", "#ff5500"},
+		{"orange", "#ffab00"},
+		{"yellow", "#ffff00"},
+		{"purple", "#6a0dad"},
+		{"hot-pink", "#ff55ff"},
+		{"pink", "#ffabff"},
+		{"white", "#ffffff"},
+	},
+	Default: "cornflowerblue",
+})
+
+func mustPalette(p *Palette) *Palette {
+	if err := p.init(); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// init validates a palette read from configuration and indexes its
+// colors.
+func (p *Palette) init() error {
+	if len(p.Colors) == 0 || len(p.Colors) > maxPaletteSize {
+		return fmt.Errorf("a palette must have between 1 and %d colors", maxPaletteSize)
+	}
+
+	p.ids = make(map[string]int, len(p.Colors))
+	p.rgba = make([]color.NRGBA, len(p.Colors))
+	for id, c := range p.Colors {
+		if c.Name == "" {
+			return errors.New("palette colors must have a name")
+		}
+		if _, ok := p.ids[c.Name]; ok {
+			return fmt.Errorf("palette color %q is listed more than once", c.Name)
+		}
+		p.ids[c.Name] = id
+
+		var r, g, b uint8
+		if _, err := fmt.Sscanf(c.RGB, "#%02x%02x%02x", &r, &g, &b); err != nil || len(c.RGB) != 7 {
+			return fmt.Errorf("palette color %q has invalid rgb %q", c.Name, c.RGB)
+		}
+		p.rgba[id] = color.NRGBA{r, g, b, 0xff}
+		p.Colors[id].RGB = strings.ToLower(c.RGB)
+	}
+
+	if p.Default == "" {
+		p.Default = p.Colors[0].Name
+	}
+	id, ok := p.ids[p.Default]
+	if !ok {
+		return fmt.Errorf("default color %q isn't in the palette", p.Default)
+	}
+	p.defaultID = id
+	return nil
+}
+
+// ID returns the ID of the named color.
+func (p *Palette) ID(name string) (int, bool) {
+	id, ok := p.ids[name]
+	return id, ok
+}
+
+// Name returns the name of the color with the given ID, or "" if there is
+// none.
+func (p *Palette) Name(id int) string {
+	if !p.Valid(id) {
+		return ""
+	}
+	return p.Colors[id].Name
+}
+
+// Valid reports whether id is the ID of a color in the palette.
+func (p *Palette) Valid(id int) bool {
+	return id >= 0 && id < len(p.Colors)
+}
+
+// DefaultID returns the ID of the default color.
+func (p *Palette) DefaultID() int {
+	return p.defaultID
+}
+
+// NRGBA returns the color with the given ID.
+func (p *Palette) NRGBA(id int) color.NRGBA {
+	if !p.Valid(id) {
+		return color.NRGBA{}
+	}
+	return p.rgba[id]
+}
+
+// ImagePalette returns the palette for rendering images, indexed by color
+// ID.
+func (p *Palette) ImagePalette() color.Palette {
+	palette := make(color.Palette, len(p.rgba))
+	for id, c := range p.rgba {
+		palette[id] = c
+	}
+	return palette
+}
+
+type paletteResponse struct {
+	Colors  []paletteColorResponse `json:"colors"`
+	Default string                 `json:"default"`
+}
+
+type paletteColorResponse struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	RGB  string `json:"rgb"`
+}
+
+// servePalette serves the '/palette' route, the colors tiles of the canvas
+// can be set to.
+func servePalette(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/palette") {
+		return
+	}
+
+	palette := paletteResponse{Colors: make([]paletteColorResponse, len(hub.palette.Colors)), Default: hub.palette.Default}
+	for id, c := range hub.palette.Colors {
+		palette.Colors[id] = paletteColorResponse{ID: id, Name: c.Name, RGB: c.RGB}
+	}
+	resp, err := json.Marshal(palette)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPaletteInit(t *testing.T) {
+	for _, tc := range []struct {
+		palette Palette
+		ok      bool
+	}{
+		{Palette{Colors: []PaletteColor{{"white", "#FFFFFF"}, {"black", "#000000"}}, Default: "black"}, true},
+		{Palette{Colors: []PaletteColor{{"white", "#ffffff"}}}, true},
+		{Palette{}, false},
+		{Palette{Colors: []PaletteColor{{"white", "#ffffff"}, {"white", "#000000"}}}, false},
+		{Palette{Colors: []PaletteColor{{"", "#ffffff"}}}, false},
+		{Palette{Colors: []PaletteColor{{"white", "white"}}}, false},
+		{Palette{Colors: []PaletteColor{{"white", "#fff"}}}, false},
+		{Palette{Colors: []PaletteColor{{"white", "#ffffff"}}, Default: "black"}, false},
+		{Palette{Colors: make([]PaletteColor, maxPaletteSize+1)}, false},
+	} {
+		p := tc.palette
+		if err := p.init(); tc.ok != (err == nil) {
+			t.Errorf("init() of %+v: got error %v", tc.palette, err)
+		}
+	}
+
+	p := Palette{Colors: []PaletteColor{{"white", "#FFFFFF"}, {"black", "#000000"}}, Default: "black"}
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := p.ID("black"); !ok || id != 1 || p.DefaultID() != 1 {
+		t.Errorf("ID(black) = %d, %v and DefaultID() = %d, want 1", id, ok, p.DefaultID())
+	}
+	if p.Valid(2) || p.Name(2) != "" || p.Name(0) != "white" {
+		t.Errorf("color 2 shouldn't exist and color 0 should be white")
+	}
+	if got := p.Colors[0].RGB; got != "#ffffff" {
+		t.Errorf("rgb = %q, want it lowercased", got)
+	}
+}
+
+func TestServePalette(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	servePalette(hub, w, httptest.NewRequest(http.MethodGet, "/palette", nil))
+	var resp paletteResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("got %d %s: %v", w.Code, w.Body, err)
+	}
+	if len(resp.Colors) != 16 || resp.Default != "cornflowerblue" {
+		t.Fatalf("got %d colors defaulting to %q, want the default palette", len(resp.Colors), resp.Default)
+	}
+	if want := (paletteColorResponse{ID: 12, Name: "purple", RGB: "#6a0dad"}); resp.Colors[12] != want {
+		t.Errorf("color 12 = %+v, want %+v", resp.Colors[12], want)
+	}
+}
@@ -2,26 +2,60 @@ package main
 
 import (
 	"database/sql"
-	"log"
-	"os"
+	"strconv"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
-var postgresClient *sql.DB
+var postgresSchema = []string{
+	"CREATE TABLE IF NOT EXISTS tile_info (canvas text NOT NULL DEFAULT 'main', username text, timestamp timestamp DEFAULT now(), x int, y int, color int)",
+	"CREATE TABLE IF NOT EXISTS placements (id bigserial PRIMARY KEY, canvas text NOT NULL DEFAULT 'main', username text, timestamp timestamp, x int, y int, color int)",
+	"CREATE TABLE IF NOT EXISTS snapshots (canvas text NOT NULL DEFAULT 'main', timestamp timestamp, width int, height int, board bytea)",
 
-func setupPostgresConnection() error {
-	var err error
-	postgresClient, err = sql.Open("pgx", os.Getenv("PG_DATABASE_URL"))
+	// tables created before there were multiple canvases belong to main
+	"ALTER TABLE tile_info ADD COLUMN IF NOT EXISTS canvas text NOT NULL DEFAULT 'main'",
+	"ALTER TABLE tile_info DROP CONSTRAINT IF EXISTS tile_info_x_y_key",
+	"ALTER TABLE placements ADD COLUMN IF NOT EXISTS canvas text NOT NULL DEFAULT 'main'",
+	"ALTER TABLE snapshots ADD COLUMN IF NOT EXISTS canvas text NOT NULL DEFAULT 'main'",
+
+	"CREATE UNIQUE INDEX IF NOT EXISTS tile_info_canvas_x_y ON tile_info (canvas, x, y)",
+	"CREATE INDEX IF NOT EXISTS placements_canvas_x_y_id ON placements (canvas, x, y, id)",
+	"CREATE INDEX IF NOT EXISTS placements_canvas_timestamp ON placements (canvas, timestamp)",
+	"CREATE INDEX IF NOT EXISTS snapshots_canvas_timestamp ON snapshots (canvas, timestamp)",
+}
+
+// newPostgresMetadataStore connects to postgres at url and creates the
+// metadata tables if they don't exist yet.
+func newPostgresMetadataStore(url string) (*sqlMetadataStore, error) {
+	db, err := sql.Open("pgx", url)
 	if err != nil {
-		log.Printf("Unable to connect to database: %v\n", err)
-		return err
+		return nil, err
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	if err = postgresClient.Ping(); err != nil {
-		return err
+	for _, statement := range postgresSchema {
+		if _, err = db.Exec(statement); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 
-	_, err = postgresClient.Exec("CREATE TABLE IF NOT EXISTS tile_info (username text, timestamp timestamp DEFAULT now(), x int, y int, color int, UNIQUE(x, y))")
-	return err
+	return &sqlMetadataStore{
+		db:                   db,
+		canvas:               defaultCanvas,
+		upsertQuery:          "INSERT INTO tile_info(canvas, username, x, y, color, timestamp) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (canvas, x, y) DO UPDATE SET username=excluded.username, timestamp=excluded.timestamp, color=excluded.color",
+		selectQuery:          "SELECT username, timestamp FROM tile_info WHERE canvas = $1 AND x = $2 AND y = $3",
+		regionQuery:          "SELECT x, y, username, timestamp FROM tile_info WHERE canvas = $1 AND x >= $2 AND x < $3 AND y >= $4 AND y < $5",
+		editedTilesQuery:     "SELECT x, y, username, color, timestamp FROM tile_info WHERE canvas = $1",
+		insertPlacementQuery: "INSERT INTO placements(canvas, username, x, y, color, timestamp) VALUES ($1, $2, $3, $4, $5, $6)",
+		historyQuery:         "SELECT id, username, color, timestamp FROM placements WHERE canvas = $1 AND x = $2 AND y = $3 AND id < $4 ORDER BY id DESC LIMIT $5",
+		placementsQuery:      "SELECT id, username, x, y, color, timestamp FROM placements WHERE canvas = $1 AND timestamp > $2 AND timestamp <= $3 ORDER BY id",
+		insertSnapshotQuery:  "INSERT INTO snapshots(canvas, timestamp, width, height, board) VALUES ($1, $2, $3, $4, $5)",
+		snapshotQuery:        "SELECT timestamp, width, height, board FROM snapshots WHERE canvas = $1 AND timestamp <= $2 ORDER BY timestamp DESC LIMIT 1",
+		placeholder:          func(n int) string { return "$" + strconv.Itoa(n) },
+	}, nil
 }
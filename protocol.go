@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Websocket subprotocols. Clients that don't ask for a subprotocol speak
+// the original plain text protocol, where tiles are sent as "x y color"
+// lines and "getTiles" is the only command.
+const (
+	textProtocol = ""
+
+	// jsonProtocol wraps every message in an envelope.
+	jsonProtocol = "rc-place.v1.json"
+
+	// binaryProtocol is the json protocol, except the board and placed
+	// tiles are sent as binary frames.
+	binaryProtocol = "rc-place.v1.binary"
+)
+
+// Binary frame types. Every binary frame starts with its type, and a
+// binary websocket message holds one or more frames.
+const (
+	// frameBoard is followed by the sequence number of the last placement
+	// on the board as a big endian uint64, the board's width and height as
+	// big endian uint16s and then the board packed the same way as a
+	// BoardStore.
+	frameBoard = 0x01
+
+	// frameTile is followed by the placement's sequence number as a big
+	// endian uint64, x and y as big endian uint16s and the color as a byte.
+	frameTile = 0x02
+
+	// frameResize is followed by the sequence number of the resize as a
+	// big endian uint64 and the board's new width and height as big endian
+	// uint16s. It's followed by a frameBoard with the resized board.
+	frameResize = 0x03
+
+	// frameBoard8 is frameBoard for canvases storing 8-bit colors, with a
+	// byte per tile.
+	frameBoard8 = 0x04
+)
+
+// Message types of the json protocol.
+const (
+	// place is sent by clients to place a tile, and by the server when
+	// any tile is placed.
+	messagePlace = "place"
+
+	// getTiles is sent by clients to request the whole board, and by the
+	// server with the board in reply and when the client connects.
+	messageGetTiles = "getTiles"
+
+	// ack is sent by the server when a place message is accepted.
+	messageAck = "ack"
+
+	// error is sent by the server when a message is rejected.
+	messageError = "error"
+
+	// cooldown is sent by the server when a place message is rejected
+	// because the user placed a tile too recently.
+	messageCooldown = "cooldown"
+
+	// resize is sent by the server when the board is resized, followed by
+	// a getTiles message with the resized board.
+	messageResize = "resize"
+)
+
+// envelope wraps every message of the json protocol. Replies carry the ID
+// of the message they're replying to, and placed tiles carry their
+// sequence number.
+type envelope struct {
+	Type    string      `json:"type"`
+	ID      string      `json:"id,omitempty"`
+	Seq     uint64      `json:"seq,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+type placePayload struct {
+	X     int `json:"x"`
+	Y     int `json:"y"`
+	Color int `json:"color"`
+}
+
+type tilesPayload struct {
+	// Seq is the sequence number of the last placement on the board.
+	Seq    uint64  `json:"seq"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Tiles  [][]int `json:"tiles"`
+}
+
+type resizePayload struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type cooldownPayload struct {
+	RetryAfterMs int64 `json:"retryAfterMs"`
+}
+
+func encodeEnvelope(messageType, id string, seq uint64, payload interface{}) []byte {
+	b, err := json.Marshal(envelope{Type: messageType, ID: id, Seq: seq, Payload: payload})
+	if err != nil {
+		// all payloads are plain structs, so this can't happen
+		panic(err)
+	}
+	return b
+}
+
+// encodeTile encodes a placed tile for clients speaking protocol. The text
+// protocol doesn't include the sequence number.
+func encodeTile(protocol string, u update) []byte {
+	switch protocol {
+	case jsonProtocol:
+		return encodeEnvelope(messagePlace, "", u.Seq, placePayload{X: u.X, Y: u.Y, Color: u.Color})
+	case sseProtocol:
+		return encodeEvent(eventPlace, u.Seq, placePayload{X: u.X, Y: u.Y, Color: u.Color})
+	case binaryProtocol:
+		frame := make([]byte, 14)
+		frame[0] = frameTile
+		binary.BigEndian.PutUint64(frame[1:], u.Seq)
+		binary.BigEndian.PutUint16(frame[9:], uint16(u.X))
+		binary.BigEndian.PutUint16(frame[11:], uint16(u.Y))
+		frame[13] = byte(u.Color)
+		return frame
+	default:
+		return []byte(fmt.Sprintf("%d %d %d\n", u.X, u.Y, u.Color))
+	}
+}
+
+// encodeResize encodes the new size of the board for clients speaking
+// protocol. seq is the sequence number of the resize. Clients speaking the
+// text protocol can't change the size of their board, so nothing is sent
+// to them.
+func encodeResize(protocol string, seq uint64, width, height int) []byte {
+	switch protocol {
+	case jsonProtocol:
+		return encodeEnvelope(messageResize, "", seq, resizePayload{Width: width, Height: height})
+	case sseProtocol:
+		return encodeEvent(eventResize, seq, resizePayload{Width: width, Height: height})
+	case binaryProtocol:
+		frame := make([]byte, 13)
+		frame[0] = frameResize
+		binary.BigEndian.PutUint64(frame[1:], seq)
+		binary.BigEndian.PutUint16(frame[9:], uint16(width))
+		binary.BigEndian.PutUint16(frame[11:], uint16(height))
+		return frame
+	default:
+		return nil
+	}
+}
+
+// encodeBoard encodes the whole board in reply to getTiles for clients
+// speaking protocol. bits is the number of bits the board's tiles are
+// stored in, and seq is the sequence number of the last placement on the
+// board.
+func encodeBoard(protocol, id string, board [][]int, bits int, seq uint64) []byte {
+	switch protocol {
+	case jsonProtocol:
+		return encodeEnvelope(messageGetTiles, id, 0, tilesPayload{Seq: seq, Width: len(board[0]), Height: len(board), Tiles: board})
+	case binaryProtocol:
+		frame := make([]byte, 13)
+		frame[0] = frameBoard
+		if bits == tileBits8 {
+			frame[0] = frameBoard8
+		}
+		binary.BigEndian.PutUint64(frame[1:], seq)
+		binary.BigEndian.PutUint16(frame[9:], uint16(len(board[0])))
+		binary.BigEndian.PutUint16(frame[11:], uint16(len(board)))
+		return append(frame, packBoard(board, bits)...)
+	default:
+		b, _ := json.Marshal(board)
+		return b
+	}
+}
+
+// encodeSync encodes the whole board for clients speaking protocol when
+// they connect. The text protocol sends a line for every tile.
+func encodeSync(protocol string, board [][]int, bits int, seq uint64) []byte {
+	if protocol == sseProtocol {
+		return encodeEvent(eventTiles, seq, tilesPayload{Seq: seq, Width: len(board[0]), Height: len(board), Tiles: board})
+	}
+	if protocol != textProtocol {
+		return encodeBoard(protocol, "", board, bits, seq)
+	}
+	var buf bytes.Buffer
+	for y := range board {
+		for x := range board[y] {
+			fmt.Fprintf(&buf, "%d %d %d\n", x, y, board[y][x])
+		}
+	}
+	return buf.Bytes()
+}
+
+// messageType returns the websocket message type to send an encoded
+// message in. Only the binary protocol uses binary messages, and its json
+// messages are told apart by their first byte.
+func messageType(protocol string, message []byte) int {
+	if protocol == binaryProtocol && len(message) > 0 && message[0] != '{' {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// handleJSONMessage handles a message from a client speaking the json or
+// binary protocol.
+func (c *Client) handleJSONMessage(data []byte) {
+	var request struct {
+		Type    string          `json:"type"`
+		ID      string          `json:"id"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &request); err != nil {
+		c.reply(encodeEnvelope(messageError, "", 0, errorPayload{Code: errorCodeMalformed, Message: err.Error()}))
+		return
+	}
+
+	switch request.Type {
+	case messageGetTiles:
+		view := c.hub.view()
+		c.reply(encodeBoard(c.protocol, request.ID, view.tiles, c.hub.tileBits, view.seq))
+	case messagePlace:
+		var place placePayload
+		if err := json.Unmarshal(request.Payload, &place); err != nil {
+			c.reply(encodeEnvelope(messageError, request.ID, 0, errorPayload{Code: errorCodeMalformed, Message: err.Error()}))
+			return
+		}
+		if err := c.hub.checkOpen(); err != nil {
+			c.reply(encodeEnvelope(messageError, request.ID, 0, errorPayload{Code: errorCode(err), Message: err.Error()}))
+			return
+		}
+		if err := c.hub.isInBounds(place.X, place.Y); err != nil {
+			c.reply(encodeEnvelope(messageError, request.ID, 0, errorPayload{Code: errorCode(err), Message: err.Error()}))
+			return
+		}
+		if !c.hub.palette.Valid(place.Color) {
+			c.reply(encodeEnvelope(messageError, request.ID, 0, errorPayload{Code: errorCodeUnknownColor, Message: "unknown color"}))
+			return
+		}
+
+		if err := c.hub.takePlacement(c.user.Username); err != nil {
+			wait, _ := retryAfter(err)
+			c.reply(encodeEnvelope(messageCooldown, request.ID, 0, cooldownPayload{RetryAfterMs: durationToMs(wait)}))
+			return
+		}
+
+		c.hub.broadcast <- &InternalMessage{X: place.X, Y: place.Y, Color: place.Color, User: *c.user, Timestamp: time.Now()}
+		c.reply(encodeEnvelope(messageAck, request.ID, 0, nil))
+	default:
+		c.reply(encodeEnvelope(messageError, request.ID, 0, errorPayload{Code: errorCodeUnknownType, Message: "unknown message type: " + request.Type}))
+	}
+}
+
+// reply queues a message for this client only. Replies are dropped if the
+// client isn't reading them fast enough.
+func (c *Client) reply(message []byte) {
+	select {
+	case c.replies <- message:
+	default:
+		log.Println("Dropping reply to slow client")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer starts a hub with an in-memory board and a server for its
+// websocket route.
+func newTestServer(t *testing.T) (*Hub, *httptest.Server) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hub.run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, &User{Id: 1, Username: r.URL.Query().Get("user")}, w, r)
+	}))
+	t.Cleanup(server.Close)
+	return hub, server
+}
+
+func dialTestServer(t *testing.T, server *httptest.Server, user string, protocols ...string) *websocket.Conn {
+	return dialTestServerPath(t, server, "/ws?user="+user, protocols...)
+}
+
+func dialTestServerPath(t *testing.T, server *httptest.Server, path string, protocols ...string) *websocket.Conn {
+	dialer := websocket.Dialer{Subprotocols: protocols}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func readEnvelope(t *testing.T, conn *websocket.Conn) (envelope, json.RawMessage) {
+	var message struct {
+		envelope
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	return message.envelope, message.Payload
+}
+
+func TestJSONProtocol(t *testing.T) {
+	_, server := newTestServer(t)
+	conn := dialTestServer(t, server, "json-user", jsonProtocol)
+	if conn.Subprotocol() != jsonProtocol {
+		t.Fatalf("negotiated protocol %q, want %q", conn.Subprotocol(), jsonProtocol)
+	}
+
+	message, payload := readEnvelope(t, conn)
+	var tiles tilesPayload
+	if err := json.Unmarshal(payload, &tiles); err != nil || message.Type != messageGetTiles {
+		t.Fatalf("first message = %s %s, want the board", message.Type, payload)
+	}
+	if tiles.Width != defaultBoardSize || tiles.Height != defaultBoardSize || tiles.Tiles[3][2] != defaultColor {
+		t.Fatalf("board = %dx%d, want %dx%d of defaultColor", tiles.Width, tiles.Height, defaultBoardSize, defaultBoardSize)
+	}
+
+	conn.WriteJSON(envelope{Type: messagePlace, ID: "1", Payload: placePayload{X: 2, Y: 3, Color: 8}})
+	// the ack and the broadcast tile may arrive in either order
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		message, payload := readEnvelope(t, conn)
+		seen[message.Type] = true
+		if message.Type == messagePlace && string(payload) != `{"x":2,"y":3,"color":8}` {
+			t.Errorf("place payload = %s", payload)
+		}
+		if message.Type == messageAck && message.ID != "1" {
+			t.Errorf("ack id = %q, want %q", message.ID, "1")
+		}
+	}
+	if !seen[messageAck] || !seen[messagePlace] {
+		t.Fatalf("got %v, want an ack and a place", seen)
+	}
+
+	for _, tc := range []struct {
+		request envelope
+		code    string
+	}{
+		{envelope{Type: messagePlace, ID: "2", Payload: placePayload{X: defaultBoardSize, Y: 0, Color: 8}}, errorCodeOutOfBounds},
+		{envelope{Type: messagePlace, ID: "3", Payload: placePayload{X: 0, Y: 0, Color: 16}}, errorCodeUnknownColor},
+		{envelope{Type: "paint", ID: "4"}, errorCodeUnknownType},
+	} {
+		// wait out the cooldown so only the error is reported
+		time.Sleep(2 * defaultUpdateLimit)
+		conn.WriteJSON(tc.request)
+		message, payload := readEnvelope(t, conn)
+		var e errorPayload
+		json.Unmarshal(payload, &e)
+		if message.Type != messageError || message.ID != tc.request.ID || e.Code != tc.code {
+			t.Errorf("reply to %s = %s %s %s, want error %s", tc.request.ID, message.Type, message.ID, payload, tc.code)
+		}
+	}
+}
+
+func TestTextProtocol(t *testing.T) {
+	_, server := newTestServer(t)
+	conn := dialTestServer(t, server, "text-user")
+	if conn.Subprotocol() != textProtocol {
+		t.Fatalf("negotiated protocol %q, want none", conn.Subprotocol())
+	}
+
+	_, board, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(board), "\n"); lines != defaultBoardSize*defaultBoardSize {
+		t.Fatalf("got %d board lines, want %d", lines, defaultBoardSize*defaultBoardSize)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("4 5 11"))
+	_, update, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(update) != "4 5 11\n" {
+		t.Fatalf("update = %q, want %q", update, "4 5 11\n")
+	}
+}
+
+func TestBinaryProtocol(t *testing.T) {
+	_, server := newTestServer(t)
+	conn := dialTestServer(t, server, "binary-user", binaryProtocol, jsonProtocol)
+	if conn.Subprotocol() != binaryProtocol {
+		t.Fatalf("negotiated protocol %q, want %q", conn.Subprotocol(), binaryProtocol)
+	}
+
+	messageType, board, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType != websocket.BinaryMessage || board[0] != frameBoard {
+		t.Fatalf("first message isn't a binary board frame")
+	}
+	if want := 13 + defaultBoardSize*defaultBoardSize/2; len(board) != want {
+		t.Fatalf("board frame is %d bytes, want %d", len(board), want)
+	}
+	seq := binary.BigEndian.Uint64(board[1:])
+	tiles := unpackBoard(board[13:], defaultBoardSize, defaultBoardSize, tileBits4)
+	if tiles[0][0] != defaultColor {
+		t.Fatalf("tile color = %d, want %d", tiles[0][0], defaultColor)
+	}
+
+	conn.WriteJSON(envelope{Type: messagePlace, ID: "1", Payload: placePayload{X: 258, Y: 1, Color: 8}})
+	message, _ := readEnvelope(t, conn)
+	if message.Type != messageError {
+		t.Fatalf("reply = %s, want an error for a tile out of bounds", message.Type)
+	}
+
+	time.Sleep(2 * defaultUpdateLimit)
+	conn.WriteJSON(envelope{Type: messagePlace, ID: "2", Payload: placePayload{X: 3, Y: 1, Color: 8}})
+	for i := 0; i < 2; i++ {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType == websocket.BinaryMessage {
+			want := []byte{frameTile, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0, 1, 8}
+			binary.BigEndian.PutUint64(want[1:], seq+1)
+			if string(data) != string(want) {
+				t.Fatalf("tile frame = %x, want %x", data, want)
+			}
+		}
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	_, server := newTestServer(t)
+	conn := dialTestServer(t, server, "resuming-user", jsonProtocol)
+	message, payload := readEnvelope(t, conn)
+	var tiles tilesPayload
+	json.Unmarshal(payload, &tiles)
+	if message.Type != messageGetTiles || tiles.Seq == 0 {
+		t.Fatalf("first message = %s %s, want the board with a seq", message.Type, payload)
+	}
+	conn.Close()
+
+	// another user places tiles while the first is disconnected
+	painter := dialTestServer(t, server, "painter", jsonProtocol)
+	readEnvelope(t, painter)
+	for i := 0; i < 3; i++ {
+		time.Sleep(2 * defaultUpdateLimit)
+		painter.WriteJSON(envelope{Type: messagePlace, ID: fmt.Sprint(i), Payload: placePayload{X: i, Y: 0, Color: 0}})
+	}
+	var last uint64
+	for last != tiles.Seq+3 {
+		message, _ := readEnvelope(t, painter)
+		if message.Type == messagePlace {
+			last = message.Seq
+		}
+	}
+
+	conn = dialTestServerPath(t, server, fmt.Sprintf("/ws?user=resuming-user&since=%d", tiles.Seq+1), jsonProtocol)
+	for _, want := range []uint64{tiles.Seq + 2, tiles.Seq + 3} {
+		message, payload := readEnvelope(t, conn)
+		if message.Type != messagePlace || message.Seq != want {
+			t.Fatalf("got %s %d %s, want the missed place %d", message.Type, message.Seq, payload, want)
+		}
+	}
+
+	// an unknown sequence number gets the whole board
+	conn = dialTestServerPath(t, server, "/ws?user=resuming-user&since=1", jsonProtocol)
+	if message, _ := readEnvelope(t, conn); message.Type != messageGetTiles {
+		t.Fatalf("got %s, want the board", message.Type)
+	}
+}
+
+func TestUpdateLog(t *testing.T) {
+	var log updateLog
+	if _, ok := log.since(0); ok {
+		t.Fatal("since() on an empty log should fail")
+	}
+	for seq := uint64(1); seq <= updateLogSize+10; seq++ {
+		log.add(update{Seq: seq})
+	}
+
+	missed, ok := log.since(updateLogSize + 5)
+	if !ok || len(missed) != 5 || missed[0].Seq != updateLogSize+6 {
+		t.Fatalf("since() = %v, %v, want the last 5 updates", missed, ok)
+	}
+	if missed, ok = log.since(updateLogSize + 10); !ok || len(missed) != 0 {
+		t.Fatalf("since() the newest update = %v, %v, want nothing", missed, ok)
+	}
+	if _, ok = log.since(5); ok {
+		t.Fatal("since() an evicted update should fail")
+	}
+	if _, ok = log.since(updateLogSize + 11); ok {
+		t.Fatal("since() a future update should fail")
+	}
+}
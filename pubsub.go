@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// instanceID identifies this process to the other rc-place instances
+// sharing a Broker, so it can ignore the placements it published itself.
+var instanceID = uuid.NewString()
+
+// brokerBufferSize is the number of published messages a subscription
+// holds before dropping them.
+const brokerBufferSize = 256
+
+// Broker fans out messages between rc-place instances, so clients see the
+// same board whichever instance they're connected to.
+type Broker interface {
+	// Publish sends payload to every subscriber of channel, including
+	// those of this instance.
+	Publish(channel string, payload []byte) error
+
+	// Subscribe returns the payloads published to channel once Subscribe
+	// has returned.
+	Subscribe(channel string) (<-chan []byte, error)
+}
+
+// newBroker creates the Broker selected by the PUBSUB environment variable.
+// Valid values are "redis" and "none". When unset, redis is used if
+// REDIS_HOST is set and none otherwise. There's no Broker for "none", and
+// each instance only broadcasts its own placements.
+func newBroker() (Broker, error) {
+	kind := os.Getenv("PUBSUB")
+	if kind == "" {
+		if _, ok := os.LookupEnv("REDIS_HOST"); ok {
+			kind = "redis"
+		} else {
+			kind = "none"
+		}
+	}
+
+	switch kind {
+	case "redis":
+		if redisClient == nil {
+			if err := setupRedisClient(); err != nil {
+				return nil, err
+			}
+		}
+		return redisBroker{redisClient}, nil
+	case "none":
+		return nil, nil
+	}
+	return nil, errors.New("unknown PUBSUB: " + kind)
+}
+
+// placementsChannel returns the channel the placements, resizes and state
+// changes of a canvas are published to, named after REDIS_PUBSUB_CHANNEL.
+func placementsChannel(canvas string) string {
+	base := os.Getenv("REDIS_PUBSUB_CHANNEL")
+	if base == "" {
+		base = "rc-place:placements"
+	}
+	return base + ":" + canvas
+}
+
+// fanoutMessage is a change applied by the instance with ID Origin. It's a
+// resize if Resize is set, a state change if State is set and a placement
+// otherwise.
+type fanoutMessage struct {
+	Origin string        `json:"origin"`
+	Resize *fanoutResize `json:"resize,omitempty"`
+	State  canvasState   `json:"state,omitempty"`
+	InternalMessage
+}
+
+// fanoutResize is the size another instance resized the board to.
+type fanoutResize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// subscribe applies the changes other instances publish to broker, and has
+// the hub publish its own. It must be called before the hub is run.
+func (h *Hub) subscribe(broker Broker, origin string) error {
+	payloads, err := broker.Subscribe(placementsChannel(h.name))
+	if err != nil {
+		return err
+	}
+	h.broker, h.origin = broker, origin
+
+	go func() {
+		for payload := range payloads {
+			var message fanoutMessage
+			if err := json.Unmarshal(payload, &message); err != nil {
+				log.Println("Dropping malformed fanout message:", err)
+				continue
+			}
+			if message.Origin == origin {
+				// already applied when it was published
+				continue
+			}
+			h.remote <- &message
+		}
+	}()
+	return nil
+}
+
+// publish sends a change applied by this instance to the others. It must
+// only be called from the hub's goroutine.
+func (h *Hub) publish(message fanoutMessage) {
+	if h.broker == nil {
+		return
+	}
+	message.Origin = h.origin
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := h.broker.Publish(placementsChannel(h.name), payload); err != nil {
+		log.Println("Failed to publish change:", err)
+	}
+}
+
+// applyRemoteResize grows the board to the size another instance resized
+// it to, keeping any dimension that's already larger. The board store is
+// reset as well, even if it's shared with the other instance, so tiles set
+// from now on are stored at the new width. It must only be called from the
+// hub's goroutine.
+func (h *Hub) applyRemoteResize(size fanoutResize) {
+	if h.archiving || h.status().State == stateArchived {
+		return
+	}
+	if size.Width <= 0 || size.Height <= 0 || size.Width > maxBoardSize || size.Height > maxBoardSize {
+		log.Printf("Dropping resize to %dx%d from another instance\n", size.Width, size.Height)
+		return
+	}
+	view := h.view()
+	width, height := view.width(), view.height()
+	if size.Width > width {
+		width = size.Width
+	}
+	if size.Height > height {
+		height = size.Height
+	}
+	if width == view.width() && height == view.height() {
+		return
+	}
+	if err := h.growBoard(width, height); err != nil {
+		log.Println("Failed to resize the board like another instance:", err)
+		return
+	}
+	log.Printf("Canvas %s was resized to %dx%d by another instance\n", h.name, width, height)
+}
+
+// applyRemoteState changes the canvas's state as another instance did,
+// archiving it here too so it stays archived after restarts. It must only be
+// called from the hub's goroutine.
+func (h *Hub) applyRemoteState(state canvasState) {
+	request := stateRequest{state: state, remote: true, done: make(chan error, 1)}
+	h.applyState(request, time.Now())
+	go func() {
+		if err := <-request.done; err != nil {
+			log.Printf("Failed to set canvas %s to %s like another instance: %v\n", h.name, state, err)
+		}
+	}()
+}
+
+// placementStamp orders placements on a tile from different instances. The
+// last placement wins, and placements made at the same time are ordered by
+// origin, so every instance ends up with the same board.
+type placementStamp struct {
+	at     time.Time
+	origin string
+}
+
+func (s placementStamp) after(other placementStamp) bool {
+	return s.at.After(other.at) || s.at.Equal(other.at) && s.origin > other.origin
+}
+
+type tileKey struct {
+	x, y int
+}
+
+// stampPlacement returns the time of a placement made on this instance at
+// now. It's moved past the last placement on the tile from another
+// instance, in case that instance's clock is ahead. It must only be called
+// from the hub's goroutine.
+func (h *Hub) stampPlacement(x, y int, now time.Time) time.Time {
+	if last, ok := h.lastPlaced[tileKey{x, y}]; ok && !now.After(last.at) {
+		now = last.at.Add(time.Nanosecond)
+	}
+	return now
+}
+
+// recordPlacement remembers the stamp of the last placement on a tile,
+// returning false if the tile already has a later placement. It's only
+// needed when placements come from more than one instance, and must only be
+// called from the hub's goroutine.
+func (h *Hub) recordPlacement(x, y int, stamp placementStamp) bool {
+	if h.broker == nil {
+		return true
+	}
+	key := tileKey{x, y}
+	if last, ok := h.lastPlaced[key]; ok && !stamp.after(last) {
+		return false
+	}
+	h.lastPlaced[key] = stamp
+	return true
+}
+
+// redisBroker is a Broker using redis pub/sub.
+type redisBroker struct {
+	client *redis.Client
+}
+
+func (b redisBroker) Publish(channel string, payload []byte) error {
+	return b.client.Publish(context.Background(), channel, payload).Err()
+}
+
+func (b redisBroker) Subscribe(channel string) (<-chan []byte, error) {
+	sub := b.client.Subscribe(context.Background(), channel)
+	// wait for the subscription to be confirmed
+	if _, err := sub.Receive(context.Background()); err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	payloads := make(chan []byte, brokerBufferSize)
+	go func() {
+		defer close(payloads)
+		for message := range sub.Channel() {
+			payloads <- []byte(message.Payload)
+		}
+	}()
+	return payloads, nil
+}
+
+// memoryBroker is a Broker for hubs in the same process, which stands in
+// for redis in tests.
+type memoryBroker struct {
+	mu          sync.Mutex
+	subscribers map[string][]chan []byte
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{subscribers: make(map[string][]chan []byte)}
+}
+
+func (b *memoryBroker) Publish(channel string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subscriber := range b.subscribers[channel] {
+		select {
+		case subscriber <- payload:
+		default:
+			log.Println("Dropping message to slow subscriber of", channel)
+		}
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(channel string) (<-chan []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subscriber := make(chan []byte, brokerBufferSize)
+	b.subscribers[channel] = append(b.subscribers[channel], subscriber)
+	return subscriber, nil
+}
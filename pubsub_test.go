@@ -0,0 +1,167 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newFanoutHub runs a hub of the default canvas stored in store, publishing
+// to broker as origin.
+func newFanoutHub(t *testing.T, store BoardStore, broker Broker, origin string) *Hub {
+	hub, err := newHub(store, noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.rateLimiter = newTokenBucketLimiter(cooldownPolicies(0))
+	if err := hub.subscribe(broker, origin); err != nil {
+		t.Fatal(err)
+	}
+	go hub.run()
+	return hub
+}
+
+// waitForTile waits until the tile at (x, y) of hub's board is color.
+func waitForTile(t *testing.T, hub *Hub, x, y, color int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.view().tiles[y][x] != color {
+		if time.Now().After(deadline) {
+			t.Fatalf("tile (%d, %d) of %s = %d, want %d", x, y, hub.origin, hub.view().tiles[y][x], color)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitFor waits until done returns true, failing with what otherwise.
+func waitFor(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFanout(t *testing.T) {
+	broker := newMemoryBroker()
+	a := newFanoutHub(t, newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), broker, "instance-a")
+	b := newFanoutHub(t, newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), broker, "instance-b")
+	startA, startB := a.view().seq, b.view().seq
+	red, _ := a.palette.ID("red")
+	blue, _ := a.palette.ID("blue")
+
+	user := &User{Id: 1, Username: "painter"}
+	if err := user.SetTile(a, 2, 3, "red"); err != nil {
+		t.Fatal(err)
+	}
+	waitForTile(t, b, 2, 3, red)
+	if err := user.SetTile(b, 4, 5, "blue"); err != nil {
+		t.Fatal(err)
+	}
+	waitForTile(t, a, 4, 5, blue)
+
+	// each instance applied both placements once, ignoring its own echo
+	if err := a.setState(stateOpen); err != nil {
+		t.Fatal(err)
+	}
+	if a.view().seq != startA+2 || b.view().seq != startB+2 {
+		t.Errorf("got %d and %d placements, want 2 each", a.view().seq-startA, b.view().seq-startB)
+	}
+}
+
+func TestFanoutResizeAndState(t *testing.T) {
+	t.Setenv("ARCHIVE_DIR", t.TempDir())
+
+	// the instances share a board store, like a redis board store would be
+	path := filepath.Join(t.TempDir(), "board.bin")
+	newStore := func() BoardStore {
+		store, err := newFileBoardStore(path, newBoardLayout(defaultBoardSize, defaultBoardSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	broker := newMemoryBroker()
+	a := newFanoutHub(t, newStore(), broker, "instance-a")
+	b := newFanoutHub(t, newStore(), broker, "instance-b")
+	red, _ := a.palette.ID("red")
+	blue, _ := a.palette.ID("blue")
+
+	user := &User{Id: 1, Username: "painter"}
+	if err := user.SetTile(a, 2, 3, "red"); err != nil {
+		t.Fatal(err)
+	}
+	waitForTile(t, b, 2, 3, red)
+	if err := a.resize(150, 120); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the resize on instance-b", func() bool { return b.view().width() == 150 && b.view().height() == 120 })
+
+	// tiles placed on either instance are stored at the new width
+	if err := user.SetTile(b, 140, 110, "blue"); err != nil {
+		t.Fatal(err)
+	}
+	waitForTile(t, a, 140, 110, blue)
+	if err := user.SetTile(b, 7, 8, "red"); err != nil {
+		t.Fatal(err)
+	}
+	waitForTile(t, a, 7, 8, red)
+	shared, err := newFileBoardStore(path, newBoardLayout(150, 120))
+	if err != nil {
+		t.Fatal(err)
+	}
+	board, err := shared.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if board[3][2] != red || board[110][140] != blue || board[8][7] != red {
+		t.Errorf("shared board store has colors %d, %d and %d, want %d, %d and %d", board[3][2], board[110][140], board[8][7], red, blue, red)
+	}
+
+	if err := a.setState(stateFrozen); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "instance-b to freeze", func() bool { return b.status().State == stateFrozen })
+	if err := user.SetTile(b, 1, 1, "red"); !isCanvasClosed(err) {
+		t.Errorf("SetTile() on the frozen instance-b: got %v, want the canvas to be closed", err)
+	}
+	if err := a.setState(stateArchived); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "instance-b to archive", func() bool { return b.status().State == stateArchived })
+}
+
+func TestApplyRemoteLastWriterWins(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.broker, hub.origin = newMemoryBroker(), "instance-b"
+	now := time.Now()
+
+	place := func(origin string, color int, at time.Time) {
+		hub.applyRemote(&fanoutMessage{Origin: origin, InternalMessage: InternalMessage{X: 1, Y: 1, Color: color, Timestamp: at}})
+	}
+	place("instance-a", 2, now)
+	place("instance-c", 3, now.Add(-time.Second))
+	if color := hub.view().tiles[1][1]; color != 2 {
+		t.Fatalf("an older placement replaced a newer one: got color %d", color)
+	}
+	place("instance-c", 3, now)
+	if color := hub.view().tiles[1][1]; color != 3 {
+		t.Fatalf("placements at the same time should be ordered by origin: got color %d", color)
+	}
+
+	// colors outside this instance's palette are dropped
+	place("instance-c", len(hub.palette.Colors), now.Add(time.Second))
+	if color := hub.view().tiles[1][1]; color != 3 {
+		t.Fatalf("a placement with an unknown color was applied: got color %d", color)
+	}
+
+	// local placements are stamped after remote ones, even if this
+	// instance's clock is behind
+	if at := hub.stampPlacement(1, 1, now.Add(-time.Minute)); !at.After(now) {
+		t.Errorf("stampPlacement = %v, want after %v", at, now)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role is the kind of user placing tiles, which can be rate limited
+// differently.
+type Role string
+
+const (
+	// RoleHuman is the role of users that aren't bots.
+	RoleHuman Role = "human"
+
+	// RoleBot is the role of users listed in the comma separated BOT_USERS
+	// environment variable.
+	RoleBot Role = "bot"
+)
+
+// userRole returns the role of the named user, whichever way they place
+// tiles.
+func userRole(username string) Role {
+	for _, bot := range strings.Split(os.Getenv("BOT_USERS"), ",") {
+		if bot = strings.TrimSpace(bot); bot != "" && bot == username {
+			return RoleBot
+		}
+	}
+	return RoleHuman
+}
+
+// roles lists every Role.
+var roles = []Role{RoleHuman, RoleBot}
+
+// RateLimit is a user's rate limit at some point in time.
+type RateLimit struct {
+	// Allowed is whether a placement can be made, or was made by Take.
+	Allowed bool
+
+	// Limit is the most placements that can be made in a burst.
+	Limit int
+
+	// Remaining is the number of placements that can be made right away.
+	Remaining int
+
+	// RetryAfter is the time until the next placement can be made, or 0 if
+	// one can be made now.
+	RetryAfter time.Duration
+
+	// Reset is the time until all Limit placements can be made again.
+	Reset time.Duration
+
+	// Interval is the time it takes to earn back one placement.
+	Interval time.Duration
+}
+
+// RateLimiter limits how often each user can place tiles on a canvas. Each
+// user has a single bucket of placements, and their role picks its policy.
+type RateLimiter interface {
+	// Take uses one of the user's placements if they have one left.
+	Take(username string, role Role, now time.Time) RateLimit
+
+	// Peek returns the user's rate limit without using a placement.
+	Peek(username string, role Role, now time.Time) RateLimit
+}
+
+// rateLimitedError is returned when a placement is rejected by the rate
+// limiter.
+type rateLimitedError struct {
+	limit RateLimit
+}
+
+func (e rateLimitedError) Error() string {
+	return errRateLimited.Error()
+}
+
+func (e rateLimitedError) Unwrap() error {
+	return errRateLimited
+}
+
+// retryAfter returns how long to wait before placing another tile if err
+// rejected a placement because of the rate limit.
+func retryAfter(err error) (time.Duration, bool) {
+	var limited rateLimitedError
+	if !errors.As(err, &limited) {
+		return 0, false
+	}
+	return limited.limit.RetryAfter, true
+}
+
+// rateLimitPolicy configures a token bucket. Users start with Capacity
+// placements and earn one back every RefillMs, up to Capacity.
+type rateLimitPolicy struct {
+	Capacity int `json:"capacity"`
+	RefillMs int `json:"refillMs"`
+}
+
+func (p rateLimitPolicy) interval() time.Duration {
+	return time.Duration(p.RefillMs) * time.Millisecond
+}
+
+// validate returns an error if the policy can't be used.
+func (p rateLimitPolicy) validate() error {
+	if p.Capacity < 1 || p.RefillMs < 0 {
+		return fmt.Errorf("capacity must be at least 1 and refillMs can't be negative, got %+v", p)
+	}
+	return nil
+}
+
+// cooldownPolicies returns the policies of a canvas where every role can
+// place a single tile every cooldown, which is the rate limit of canvases
+// that don't configure one.
+func cooldownPolicies(cooldownMs int) map[Role]rateLimitPolicy {
+	policies := make(map[Role]rateLimitPolicy, len(roles))
+	for _, role := range roles {
+		policies[role] = rateLimitPolicy{Capacity: 1, RefillMs: cooldownMs}
+	}
+	return policies
+}
+
+// tokenBucket holds the placements a user has left. tokens is only up to
+// date as of updated.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// tokenBucketLimiter is a RateLimiter keeping a token bucket in memory for
+// every user.
+type tokenBucketLimiter struct {
+	policies map[Role]rateLimitPolicy
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter creates the RateLimiter of a canvas selected by the
+// RATE_LIMIT_STORE environment variable. Valid values are "redis", which
+// shares rate limits between instances, and "memory". When unset, redis is
+// used if REDIS_HOST is set and memory otherwise.
+func newRateLimiter(canvas canvasConfig) (RateLimiter, error) {
+	kind := os.Getenv("RATE_LIMIT_STORE")
+	if kind == "" {
+		if _, ok := os.LookupEnv("REDIS_HOST"); ok {
+			kind = "redis"
+		} else {
+			kind = "memory"
+		}
+	}
+
+	switch kind {
+	case "redis":
+		if redisClient == nil {
+			if err := setupRedisClient(); err != nil {
+				return nil, err
+			}
+		}
+		prefix := os.Getenv("REDIS_RATE_LIMIT_KEY")
+		if prefix == "" {
+			prefix = "rc-place:ratelimit"
+		}
+		return newRedisRateLimiter(redisClient, prefix+":"+canvas.Name, canvas.RateLimits), nil
+	case "memory":
+		return newTokenBucketLimiter(canvas.RateLimits), nil
+	}
+	return nil, errors.New("unknown RATE_LIMIT_STORE: " + kind)
+}
+
+func newTokenBucketLimiter(policies map[Role]rateLimitPolicy) *tokenBucketLimiter {
+	return &tokenBucketLimiter{policies: policies, buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *tokenBucketLimiter) Take(username string, role Role, now time.Time) RateLimit {
+	return l.limit(username, role, now, true)
+}
+
+func (l *tokenBucketLimiter) Peek(username string, role Role, now time.Time) RateLimit {
+	return l.limit(username, role, now, false)
+}
+
+// limit refills the user's bucket as of now, and takes a token from it if
+// take is set and one is left.
+func (l *tokenBucketLimiter) limit(username string, role Role, now time.Time, take bool) RateLimit {
+	policy := l.policies[role]
+	interval := policy.interval()
+	capacity := float64(policy.Capacity)
+	if interval <= 0 {
+		// placements are earned back right away
+		return RateLimit{Allowed: true, Limit: policy.Capacity, Remaining: policy.Capacity}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[username]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, updated: now}
+	}
+	if elapsed := now.Sub(bucket.updated); elapsed > 0 {
+		bucket.tokens = math.Min(capacity, bucket.tokens+float64(elapsed)/float64(interval))
+		bucket.updated = now
+	}
+
+	allowed := bucket.tokens >= 1
+	if take && allowed {
+		bucket.tokens--
+	}
+	if bucket.tokens < capacity {
+		l.buckets[username] = bucket
+	} else {
+		// full buckets are the same as new ones
+		delete(l.buckets, username)
+	}
+	return bucketLimit(policy, allowed, bucket.tokens)
+}
+
+// bucketLimit returns the rate limit of a token bucket with tokens left.
+func bucketLimit(policy rateLimitPolicy, allowed bool, tokens float64) RateLimit {
+	interval := policy.interval()
+	limit := RateLimit{
+		Allowed:   allowed,
+		Limit:     policy.Capacity,
+		Remaining: int(tokens),
+		Reset:     time.Duration((float64(policy.Capacity) - tokens) * float64(interval)),
+		Interval:  interval,
+	}
+	if tokens < 1 {
+		limit.RetryAfter = time.Duration((1 - tokens) * float64(interval))
+	}
+	return limit
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	limiter := newTokenBucketLimiter(map[Role]rateLimitPolicy{
+		RoleHuman: {Capacity: 3, RefillMs: 1000},
+		RoleBot:   {Capacity: 5, RefillMs: 1000},
+	})
+	now := time.Now()
+
+	// a burst of capacity placements is allowed
+	for i := 0; i < 3; i++ {
+		if limit := limiter.Take("painter", RoleHuman, now); !limit.Allowed || limit.Remaining != 2-i {
+			t.Fatalf("placement %d: got %+v, want allowed with %d remaining", i, limit, 2-i)
+		}
+	}
+	limit := limiter.Take("painter", RoleHuman, now)
+	if limit.Allowed || limit.RetryAfter != time.Second || limit.Reset != 3*time.Second || limit.Limit != 3 {
+		t.Fatalf("placement past the burst: got %+v, want a 1s wait", limit)
+	}
+
+	// other users have their own buckets, while a user has a single bucket
+	// whatever policy is applied to it
+	if limit := limiter.Take("someone-else", RoleHuman, now); !limit.Allowed {
+		t.Fatalf("another user: got %+v, want allowed", limit)
+	}
+	if limit := limiter.Take("painter", RoleBot, now); limit.Allowed || limit.Limit != 5 {
+		t.Fatalf("placement with another policy: got %+v, want the empty bucket with the bot policy", limit)
+	}
+
+	// tokens are earned back over time, and peeking doesn't use them
+	now = now.Add(1500 * time.Millisecond)
+	if limit := limiter.Peek("painter", RoleHuman, now); !limit.Allowed || limit.Remaining != 1 || limit.RetryAfter != 0 {
+		t.Fatalf("peek after 1.5s: got %+v, want one placement remaining", limit)
+	}
+	limiter.Take("painter", RoleHuman, now)
+	if limit := limiter.Take("painter", RoleHuman, now); limit.Allowed || limit.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("placement after using the refill: got %+v, want a 500ms wait", limit)
+	}
+
+	// full buckets aren't kept
+	now = now.Add(time.Hour)
+	limiter.Peek("painter", RoleHuman, now)
+	limiter.Peek("someone-else", RoleHuman, now)
+	if len(limiter.buckets) != 0 {
+		t.Fatalf("got %d buckets after they refilled, want 0", len(limiter.buckets))
+	}
+
+	// policies without a refill time don't limit placements
+	limiter = newTokenBucketLimiter(cooldownPolicies(0))
+	for i := 0; i < 5; i++ {
+		if limit := limiter.Take("painter", RoleHuman, now); !limit.Allowed {
+			t.Fatalf("placement %d without a refill time: got %+v, want allowed", i, limit)
+		}
+	}
+}
+
+func TestUserRole(t *testing.T) {
+	t.Setenv("BOT_USERS", "painter-bot, other-bot")
+	for username, want := range map[string]Role{"painter-bot": RoleBot, "other-bot": RoleBot, "painter": RoleHuman, "": RoleHuman} {
+		if role := userRole(username); role != want {
+			t.Errorf("userRole(%q) = %s, want %s", username, role, want)
+		}
+	}
+}
+
+func TestSetTileRateLimit(t *testing.T) {
+	hub, err := newHub(newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize)), noopMetadataStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.rateLimiter = newTokenBucketLimiter(map[Role]rateLimitPolicy{
+		RoleHuman: {Capacity: 1, RefillMs: 60000},
+		RoleBot:   {Capacity: 2, RefillMs: 60000},
+	})
+	go hub.run()
+
+	t.Setenv("BOT_USERS", "bot-user")
+	user := &User{Id: 1, Username: "bot-user"}
+	for i := 0; i < 2; i++ {
+		if err := user.SetTile(hub, i, 0, "red"); err != nil {
+			t.Fatalf("placement %d: %v", i, err)
+		}
+	}
+	err = user.SetTile(hub, 2, 0, "red")
+	if wait, ok := retryAfter(err); !ok || wait <= 0 {
+		t.Fatalf("placement past the burst = %v, want rate limited", err)
+	}
+	// websocket placements come out of the same bucket
+	if _, ok := retryAfter(hub.takePlacement(user.Username)); !ok {
+		t.Fatalf("websocket placement after using the burst over REST wasn't rate limited")
+	}
+
+	// invalid placements don't use up the rate limit
+	hub.rateLimiter = newTokenBucketLimiter(cooldownPolicies(60000))
+	if err := user.SetTile(hub, defaultBoardSize, 0, "red"); err == nil {
+		t.Fatal("out of bounds placement was accepted")
+	}
+	if err := user.SetTile(hub, 0, 0, "red"); err != nil {
+		t.Fatalf("placement after an invalid one: %v", err)
+	}
+}
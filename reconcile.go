@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Ways of reconciling the board store with tile_info, set by the RECONCILE
+// environment variable on startup and the -rebuild flag of the reconcile
+// subcommand.
+const (
+	// reconcileReport logs the tiles whose colors differ.
+	reconcileReport = "report"
+
+	// reconcileBoard sets the differing tiles of the board store to the
+	// color of their latest edit in tile_info.
+	reconcileBoard = "board"
+
+	// reconcileMetadata sets the color of the differing tiles' latest
+	// edits to their color in the board store.
+	reconcileMetadata = "metadata"
+
+	// reconcileNone skips reconciling.
+	reconcileNone = "none"
+)
+
+// maxLoggedDiffs limits the differing tiles logged for each canvas.
+const maxLoggedDiffs = 20
+
+// tileDiff is an edited tile whose color in the board store differs from
+// the color of its latest edit in tile_info.
+type tileDiff struct {
+	X     int
+	Y     int
+	Board int
+	Edit  Placement
+}
+
+// reconcileMode returns the RECONCILE environment variable, defaulting to
+// reconcileReport.
+func reconcileMode() (string, error) {
+	mode := os.Getenv("RECONCILE")
+	if mode == "" {
+		return reconcileReport, nil
+	}
+	return mode, checkReconcileMode(mode)
+}
+
+func checkReconcileMode(mode string) error {
+	switch mode {
+	case reconcileReport, reconcileBoard, reconcileMetadata, reconcileNone:
+		return nil
+	}
+	return fmt.Errorf("unknown reconcile mode %q, want one of report, board, metadata or none", mode)
+}
+
+// diffBoard returns the tiles of board whose color differs from their
+// latest edit. Tiles that were never edited aren't compared, since
+// tile_info doesn't know their color, and edits outside the board are
+// ignored.
+func diffBoard(board [][]int, edits []Placement) []tileDiff {
+	var diffs []tileDiff
+	for _, edit := range edits {
+		if edit.Y < 0 || edit.Y >= len(board) || edit.X < 0 || edit.X >= len(board[edit.Y]) {
+			continue
+		}
+		if color := board[edit.Y][edit.X]; color != edit.Color {
+			diffs = append(diffs, tileDiff{X: edit.X, Y: edit.Y, Board: color, Edit: edit})
+		}
+	}
+	return diffs
+}
+
+// reconcile compares the board in store with the latest edits in metadata,
+// logs the tiles that differ and repairs them as mode says. Writes queued
+// for metadata are written first, and nothing is compared while they can't
+// be. Rebuilding metadata only changes the color of the latest edits,
+// keeping who made them and when. It returns errNoHistory if metadata isn't
+// recorded.
+func reconcile(name string, store BoardStore, metadata TileMetadataStore, mode string) ([]tileDiff, error) {
+	if mode == reconcileNone {
+		return nil, nil
+	}
+	// tile_info is only up to date once queued writes, including ones
+	// spilled before a restart, are written
+	if queued, ok := metadata.(metadataFlusher); ok {
+		if err := queued.Flush(); err != nil {
+			return nil, fmt.Errorf("can't reconcile with tile_info before its queued writes are written: %w", err)
+		}
+	}
+	edits, err := metadata.GetEditedTiles()
+	if err != nil {
+		return nil, err
+	}
+	board, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := diffBoard(board, edits)
+	if len(diffs) == 0 {
+		return nil, nil
+	}
+	log.Printf("Canvas %s: %d of %d edited tiles differ between the board store and tile_info\n", name, len(diffs), len(edits))
+	for i, diff := range diffs {
+		if i == maxLoggedDiffs {
+			log.Printf("  and %d more\n", len(diffs)-maxLoggedDiffs)
+			break
+		}
+		log.Printf("  (%d, %d): board store %d, tile_info %d by %s at %s\n", diff.X, diff.Y, diff.Board, diff.Edit.Color, diff.Edit.Username, diff.Edit.Timestamp.Format(time.RFC3339))
+	}
+
+	switch mode {
+	case reconcileBoard:
+		for _, diff := range diffs {
+			board[diff.Y][diff.X] = diff.Edit.Color
+		}
+		if err := store.Reset(board); err != nil {
+			return diffs, err
+		}
+		log.Printf("Canvas %s: rebuilt %d tiles of the board store from tile_info\n", name, len(diffs))
+	case reconcileMetadata:
+		for _, diff := range diffs {
+			message := InternalMessage{X: diff.X, Y: diff.Y, Color: diff.Board, User: User{Username: diff.Edit.Username}, Timestamp: diff.Edit.Timestamp}
+			if err := metadata.SetTileInfo(message); err != nil {
+				return diffs, err
+			}
+		}
+		log.Printf("Canvas %s: rebuilt %d tiles of tile_info from the board store\n", name, len(diffs))
+	}
+	return diffs, nil
+}
+
+// runReconcile runs the reconcile subcommand, which reconciles the board
+// store and tile_info of every canvas, and returns its exit code. It
+// exits with 1 if tiles differ and weren't rebuilt.
+func runReconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	rebuild := flags.String("rebuild", "", `rebuild the differing tiles of the "board" store from tile_info, or of tile_info from the board store with "metadata"`)
+	only := flags.String("canvas", "", "only reconcile the named canvas")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	mode := reconcileReport
+	if *rebuild != "" {
+		mode = *rebuild
+		if mode != reconcileBoard && mode != reconcileMetadata {
+			log.Printf("-rebuild must be board or metadata, got %q\n", mode)
+			return 2
+		}
+	}
+
+	configs, err := loadCanvasConfigs()
+	if err != nil {
+		log.Println("Error reading canvases:", err)
+		return 1
+	}
+	metadata := newTileMetadataStore()
+	defer metadata.Close()
+
+	found, differ := false, false
+	for _, config := range configs {
+		if *only != "" && config.Name != *only {
+			continue
+		}
+		found = true
+		store, err := newBoardStore(config)
+		if err != nil {
+			log.Printf("Error setting up the board store of canvas %s: %v\n", config.Name, err)
+			return 1
+		}
+		diffs, err := reconcile(config.Name, store, metadata.Canvas(config.Name), mode)
+		if errors.Is(err, errNoHistory) {
+			log.Println("Tile metadata isn't recorded, so there's nothing to reconcile")
+			return 1
+		}
+		if err != nil {
+			log.Printf("Error reconciling canvas %s: %v\n", config.Name, err)
+			return 1
+		}
+		if len(diffs) == 0 {
+			log.Printf("Canvas %s: the board store and tile_info agree\n", config.Name)
+		}
+		differ = differ || len(diffs) > 0
+	}
+	if !found {
+		log.Println("Unknown canvas:", *only)
+		return 1
+	}
+	if differ && mode == reconcileReport {
+		return 1
+	}
+	return 0
+}
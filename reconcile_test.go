@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReconcile(t *testing.T) {
+	metadata, err := newSQLiteMetadataStore(filepath.Join(t.TempDir(), "rc-place.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metadata.Close()
+
+	// (1, 1) agrees, while (2, 1) and (3, 1) were lost by the board store
+	at := time.Date(2022, 3, 21, 12, 0, 0, 0, time.UTC)
+	for x, color := range map[int]int{1: 2, 2: 3, 3: 4} {
+		if err := metadata.SetTileInfo(InternalMessage{X: x, Y: 1, Color: color, User: User{Username: "painter"}, Timestamp: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// edits outside the board are ignored
+	if err := metadata.SetTileInfo(InternalMessage{X: defaultBoardSize, Y: 1, Color: 1, Timestamp: at}); err != nil {
+		t.Fatal(err)
+	}
+	newStore := func() BoardStore {
+		store := newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize))
+		store.SetTile(1, 1, 2)
+		return store
+	}
+
+	store := newStore()
+	diffs, err := reconcile(defaultCanvas, store, metadata, reconcileReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 {
+		t.Fatalf("reconcile() = %+v, want tiles (2, 1) and (3, 1)", diffs)
+	}
+	if board, _ := store.Load(); board[1][2] != defaultColor {
+		t.Errorf("reporting changed the board store")
+	}
+
+	if _, err := reconcile(defaultCanvas, store, metadata, reconcileBoard); err != nil {
+		t.Fatal(err)
+	}
+	if board, _ := store.Load(); board[1][2] != 3 || board[1][3] != 4 {
+		t.Errorf("board store wasn't rebuilt from tile_info: got colors %d and %d", board[1][2], board[1][3])
+	}
+	if diffs, _ := reconcile(defaultCanvas, store, metadata, reconcileReport); len(diffs) != 0 {
+		t.Errorf("tiles still differ after rebuilding the board store: %+v", diffs)
+	}
+
+	if _, err := reconcile(defaultCanvas, newStore(), metadata, reconcileMetadata); err != nil {
+		t.Fatal(err)
+	}
+	edits, err := metadata.GetEditedTiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, edit := range edits {
+		if edit.X == 2 && (edit.Color != defaultColor || edit.Username != "painter" || !edit.Timestamp.Equal(at)) {
+			t.Errorf("tile_info of (2, 1) = %+v, want the board store's color from the same edit", edit)
+		}
+	}
+
+	if _, err := reconcile(defaultCanvas, store, noopMetadataStore{}, reconcileReport); !errors.Is(err, errNoHistory) {
+		t.Errorf("reconcile() without metadata: got %v, want errNoHistory", err)
+	}
+}
+
+func TestReconcileWaitsForQueuedWrites(t *testing.T) {
+	metadata, err := newSQLiteMetadataStore(filepath.Join(t.TempDir(), "rc-place.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metadata.Close()
+	if err := metadata.SetTileInfo(InternalMessage{X: 1, Y: 1, Color: 2, Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a newer edit of the tile is queued while the database is down
+	writer := newMetadataWriter(&flakyBatchWriter{down: true}, newMetadataQueue(defaultMetadataQueueSize, nil))
+	defer writer.close()
+	queued := &asyncMetadataStore{metadata, writer}
+	queued.SetTileInfo(InternalMessage{X: 1, Y: 1, Color: 3, Timestamp: time.Now()})
+
+	store := newMemoryBoardStore(newBoardLayout(defaultBoardSize, defaultBoardSize))
+	store.SetTile(1, 1, 3)
+	if _, err := reconcile(defaultCanvas, store, queued, reconcileBoard); err == nil {
+		t.Fatal("reconcile() with queued writes: want an error")
+	}
+	if board, _ := store.Load(); board[1][1] != 3 {
+		t.Errorf("board store was rebuilt from an out of date tile_info: got color %d", board[1][1])
+	}
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -24,3 +28,250 @@ func setupRedisClient() error {
 func getColorsFromByte(b byte) (firstColor, secondColor int) {
 	return (int(b >> 4)), (int(b & 15))
 }
+
+// redisBoardStore stores the board in a redis u4 or u8 bitfield, where the
+// tile at (x, y) is at offset x + width*y. Its width and height are stored
+// in the hash at sizeKey.
+type redisBoardStore struct {
+	boardLayout
+	client *redis.Client
+	key    string
+}
+
+func newRedisBoardStore(client *redis.Client, key string, layout boardLayout) *redisBoardStore {
+	return &redisBoardStore{boardLayout: layout, client: client, key: key}
+}
+
+// sizeKey returns the key of the hash holding the board's dimensions.
+// Canvas names can't start with an underscore, so it's never the key of
+// another canvas's board.
+func (s *redisBoardStore) sizeKey() string {
+	return s.key + ":_size"
+}
+
+func (s *redisBoardStore) Load() ([][]int, error) {
+	ctx := context.Background()
+	bytes, err := s.client.Get(ctx, s.key).Bytes()
+	if err == redis.Nil {
+		// initialize the bitfield
+		board := newBoard(s.width, s.height, s.blank)
+		if err := s.Reset(board); err != nil {
+			return nil, err
+		}
+		return board, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := s.client.HMGet(ctx, s.sizeKey(), "width", "height").Result()
+	if err != nil {
+		return nil, err
+	}
+	sized := size[0] != nil && size[1] != nil
+	if sized {
+		width, errWidth := strconv.Atoi(fmt.Sprint(size[0]))
+		height, errHeight := strconv.Atoi(fmt.Sprint(size[1]))
+		if errWidth != nil || errHeight != nil || width <= 0 || height <= 0 {
+			return nil, fmt.Errorf("malformed board dimensions at %s: %v", s.sizeKey(), size)
+		}
+		s.width, s.height = width, height
+	}
+	if err := s.checkPackedSize(bytes, sized); err != nil {
+		return nil, err
+	}
+	if !sized {
+		// the board was stored before its dimensions were
+		if err := s.client.HSet(ctx, s.sizeKey(), "width", s.width, "height", s.height).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return unpackBoard(bytes, s.width, s.height, s.bits), nil
+}
+
+func (s *redisBoardStore) SetTile(x, y, color int) error {
+	offset := y*s.width + x
+	return s.client.BitField(context.Background(), s.key, "SET", fmt.Sprintf("u%d", s.bits), fmt.Sprintf("#%d", offset), color).Err()
+}
+
+func (s *redisBoardStore) Snapshot() ([]byte, error) {
+	return s.client.Get(context.Background(), s.key).Bytes()
+}
+
+func (s *redisBoardStore) Reset(board [][]int) error {
+	ctx := context.Background()
+	width, height := len(board[0]), len(board)
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.key, packBoard(board, s.bits), 0)
+		pipe.HSet(ctx, s.sizeKey(), "width", width, "height", height)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.width, s.height = width, height
+	return nil
+}
+
+func (s *redisBoardStore) Layout() boardLayout {
+	return s.boardLayout
+}
+
+// redisRateLimiter is a RateLimiter keeping rate limits in redis, so they're
+// shared between instances and kept across restarts. Every key expires
+// once the user's placements are earned back.
+type redisRateLimiter struct {
+	client   *redis.Client
+	prefix   string
+	policies map[Role]rateLimitPolicy
+}
+
+func newRedisRateLimiter(client *redis.Client, prefix string, policies map[Role]rateLimitPolicy) *redisRateLimiter {
+	return &redisRateLimiter{client: client, prefix: prefix, policies: policies}
+}
+
+// tokenBucketScript refills and takes from a token bucket like
+// tokenBucketLimiter, in a hash expiring when the bucket is full again.
+// Tokens are returned as a string, as redis truncates numbers to integers.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tokens, updated = capacity, now
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+if bucket[1] then
+	tokens, updated = tonumber(bucket[1]), tonumber(bucket[2])
+end
+if now > updated then
+	tokens = math.min(capacity, tokens + (now - updated) / interval)
+	updated = now
+end
+
+local allowed = 0
+if tokens >= 1 then
+	allowed = 1
+	if ARGV[4] == '1' then
+		tokens = tokens - 1
+	end
+end
+if tokens < capacity then
+	redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', updated)
+	redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) * interval))
+else
+	redis.call('DEL', KEYS[1])
+end
+return {allowed, tostring(tokens)}
+`)
+
+func (l *redisRateLimiter) Take(username string, role Role, now time.Time) RateLimit {
+	return l.limit(username, role, now, true)
+}
+
+func (l *redisRateLimiter) Peek(username string, role Role, now time.Time) RateLimit {
+	return l.limit(username, role, now, false)
+}
+
+// limit returns the user's rate limit, taking a placement if take is set
+// and one is left. Placements are allowed if redis can't be reached, as
+// rate limits aren't worth stopping the canvas for.
+func (l *redisRateLimiter) limit(username string, role Role, now time.Time, take bool) RateLimit {
+	policy := l.policies[role]
+	interval := policy.interval()
+	unlimited := RateLimit{Allowed: true, Limit: policy.Capacity, Remaining: policy.Capacity, Interval: interval}
+	if interval <= 0 {
+		return unlimited
+	}
+
+	key := l.prefix + ":" + username
+	if policy.Capacity == 1 {
+		limit, err := l.cooldown(key, interval, take)
+		if err != nil {
+			log.Println("Failed to check rate limit:", err)
+			return unlimited
+		}
+		return limit
+	}
+
+	result, err := tokenBucketScript.Run(context.Background(), l.client, []string{key},
+		policy.Capacity, interval.Milliseconds(), now.UnixMilli(), take).Slice()
+	if err != nil {
+		log.Println("Failed to check rate limit:", err)
+		return unlimited
+	}
+	allowed, _ := result[0].(int64)
+	tokens, err := strconv.ParseFloat(fmt.Sprint(result[1]), 64)
+	if err != nil {
+		log.Println("Failed to check rate limit:", err)
+		return unlimited
+	}
+	return bucketLimit(policy, allowed == 1, tokens)
+}
+
+// cooldown is the rate limit of a user who can place one tile every
+// interval. The key exists until they can place another.
+func (l *redisRateLimiter) cooldown(key string, interval time.Duration, take bool) (RateLimit, error) {
+	ctx := context.Background()
+	if take {
+		ok, err := l.client.SetNX(ctx, key, 1, interval).Result()
+		if err != nil {
+			return RateLimit{}, err
+		}
+		if ok {
+			return RateLimit{Allowed: true, Limit: 1, RetryAfter: interval, Reset: interval, Interval: interval}, nil
+		}
+	}
+
+	wait, err := l.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return RateLimit{}, err
+	}
+	if wait <= 0 && !take {
+		return RateLimit{Allowed: true, Limit: 1, Remaining: 1, Interval: interval}, nil
+	}
+	if wait <= 0 {
+		// the cooldown ended after SetNX, so the user can retry right away
+		wait = time.Millisecond
+	}
+	return RateLimit{Limit: 1, RetryAfter: wait, Reset: wait, Interval: interval}, nil
+}
+
+// redisSessionStore is a SessionStore keeping every session in a redis hash
+// that expires after sessionTTL, so users stay logged in across instances
+// and restarts.
+type redisSessionStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisSessionStore(client *redis.Client, prefix string) *redisSessionStore {
+	return &redisSessionStore{client: client, prefix: prefix}
+}
+
+func (s *redisSessionStore) Get(token string) (*Session, error) {
+	fields, err := s.client.HGetAll(context.Background(), s.prefix+":"+token).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errNoSession
+	}
+	id, err := strconv.Atoi(fields["id"])
+	if err != nil {
+		return nil, err
+	}
+	return &Session{User: User{Id: id, Username: fields["username"]}, State: fields["state"]}, nil
+}
+
+func (s *redisSessionStore) Set(token string, session Session) error {
+	key := s.prefix + ":" + token
+	_, err := s.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.HSet(context.Background(), key, "id", session.Id, "username", session.Username, "state", session.State)
+		pipe.Expire(context.Background(), key, sessionTTL)
+		return nil
+	})
+	return err
+}
+
+func (s *redisSessionStore) Delete(token string) error {
+	return s.client.Del(context.Background(), s.prefix+":"+token).Err()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// newTestRedisClient connects to the redis at REDIS_HOST, skipping the test
+// if it isn't set. It returns a key prefix unique to the test, whose keys
+// are deleted when the test ends.
+func newTestRedisClient(t *testing.T) (*redis.Client, string) {
+	if _, ok := os.LookupEnv("REDIS_HOST"); !ok {
+		t.Skip("REDIS_HOST isn't set")
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     os.Getenv("REDIS_HOST"),
+		Password: os.Getenv("REDIS_PASSWORD"),
+	})
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+	prefix := "rc-place-test:" + uuid.NewString()
+	t.Cleanup(func() {
+		if keys, err := client.Keys(ctx, prefix+":*").Result(); err == nil && len(keys) > 0 {
+			client.Del(ctx, keys...)
+		}
+		client.Close()
+	})
+	return client, prefix
+}
+
+func TestRedisTokenBucket(t *testing.T) {
+	client, prefix := newTestRedisClient(t)
+	// refills are slow enough that keys don't expire during the test
+	limiter := newRedisRateLimiter(client, prefix, map[Role]rateLimitPolicy{
+		RoleHuman: {Capacity: 3, RefillMs: 60000},
+		RoleBot:   {Capacity: 5, RefillMs: 60000},
+	})
+	now := time.Now()
+
+	// a burst of capacity placements is allowed
+	for i := 0; i < 3; i++ {
+		if limit := limiter.Take("painter", RoleHuman, now); !limit.Allowed || limit.Remaining != 2-i {
+			t.Fatalf("placement %d: got %+v, want allowed with %d remaining", i, limit, 2-i)
+		}
+	}
+	limit := limiter.Take("painter", RoleHuman, now)
+	if limit.Allowed || limit.RetryAfter != time.Minute || limit.Reset != 3*time.Minute || limit.Limit != 3 {
+		t.Fatalf("placement past the burst: got %+v, want a 1m wait", limit)
+	}
+	ttl, err := client.PTTL(context.Background(), prefix+":painter").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= 2*time.Minute || ttl > 3*time.Minute {
+		t.Errorf("bucket expires in %v, want once it's full again in 3m", ttl)
+	}
+
+	// other users have their own buckets, while a user has a single bucket
+	// whatever policy is applied to it
+	if limit := limiter.Take("someone-else", RoleHuman, now); !limit.Allowed {
+		t.Fatalf("another user: got %+v, want allowed", limit)
+	}
+	if limit := limiter.Take("painter", RoleBot, now); limit.Allowed || limit.Limit != 5 {
+		t.Fatalf("placement with another policy: got %+v, want the empty bucket with the bot policy", limit)
+	}
+
+	// tokens are earned back over time, and peeking doesn't use them
+	now = now.Add(90 * time.Second)
+	if limit := limiter.Peek("painter", RoleHuman, now); !limit.Allowed || limit.Remaining != 1 || limit.RetryAfter != 0 {
+		t.Fatalf("peek after 1.5m: got %+v, want one placement remaining", limit)
+	}
+	limiter.Take("painter", RoleHuman, now)
+	if limit := limiter.Take("painter", RoleHuman, now); limit.Allowed || limit.RetryAfter != 30*time.Second {
+		t.Fatalf("placement after using the refill: got %+v, want a 30s wait", limit)
+	}
+
+	// full buckets aren't kept
+	now = now.Add(time.Hour)
+	limiter.Peek("painter", RoleHuman, now)
+	if n, err := client.Exists(context.Background(), prefix+":painter").Result(); err != nil || n != 0 {
+		t.Errorf("full bucket is still stored: %d, %v", n, err)
+	}
+}
+
+func TestRedisCooldown(t *testing.T) {
+	client, prefix := newTestRedisClient(t)
+	const cooldown = 200 * time.Millisecond
+	limiter := newRedisRateLimiter(client, prefix, cooldownPolicies(int(cooldown.Milliseconds())))
+
+	if limit := limiter.Take("painter", RoleHuman, time.Now()); !limit.Allowed || limit.RetryAfter != cooldown {
+		t.Fatalf("first placement: got %+v, want allowed with a %v cooldown", limit, cooldown)
+	}
+	limit := limiter.Take("painter", RoleHuman, time.Now())
+	if limit.Allowed || limit.RetryAfter <= 0 || limit.RetryAfter > cooldown {
+		t.Fatalf("placement during the cooldown: got %+v, want a wait of at most %v", limit, cooldown)
+	}
+	if limit := limiter.Peek("painter", RoleHuman, time.Now()); limit.Allowed {
+		t.Fatalf("peek during the cooldown: got %+v, want not allowed", limit)
+	}
+	if limit := limiter.Peek("someone-else", RoleHuman, time.Now()); !limit.Allowed || limit.Remaining != 1 {
+		t.Fatalf("peek for another user: got %+v, want allowed", limit)
+	}
+
+	// the key expires when the cooldown ends
+	time.Sleep(limit.RetryAfter + 50*time.Millisecond)
+	if limit := limiter.Take("painter", RoleHuman, time.Now()); !limit.Allowed {
+		t.Fatalf("placement after the cooldown: got %+v, want allowed", limit)
+	}
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	client, prefix := newTestRedisClient(t)
+	store := newRedisSessionStore(client, prefix)
+
+	if _, err := store.Get("token"); !errors.Is(err, errNoSession) {
+		t.Fatalf("Get() of an unknown token: got %v, want errNoSession", err)
+	}
+	session := Session{User: User{Id: 7, Username: "painter"}, State: "oauth-state"}
+	if err := store.Set("token", session); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != session {
+		t.Errorf("Get() = %+v, want %+v", *got, session)
+	}
+	ttl, err := client.TTL(context.Background(), prefix+":token").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= sessionTTL-time.Minute || ttl > sessionTTL {
+		t.Errorf("session expires in %v, want %v", ttl, sessionTTL)
+	}
+
+	if err := store.Delete("token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("token"); !errors.Is(err, errNoSession) {
+		t.Errorf("Get() after Delete(): got %v, want errNoSession", err)
+	}
+}
+
+func TestRedisBoardStoreKeepsDimensions(t *testing.T) {
+	client, prefix := newTestRedisClient(t)
+	store := newRedisBoardStore(client, prefix+":board", newBoardLayout(10, 10))
+	if _, err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	grown := newBoard(20, 20, defaultColor)
+	grown[9][9] = 8
+	if err := store.Reset(grown); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart with the configured dimensions loads the resized board
+	restarted := newRedisBoardStore(client, prefix+":board", newBoardLayout(10, 10))
+	board, err := restarted.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(board) != 20 || len(board[0]) != 20 || board[9][9] != 8 {
+		t.Errorf("Load() = a %dx%d board, want the resized 20x20 one", len(board[0]), len(board))
+	}
+
+	// boards stored before their dimensions were are loaded at the
+	// configured ones, which are stored from then on
+	legacy := prefix + ":legacy"
+	if err := client.Set(context.Background(), legacy, packBoard(newBoard(10, 10, defaultColor), tileBits4), 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRedisBoardStore(client, legacy, newBoardLayout(12, 10)).Load(); err == nil {
+		t.Error("Load() of a board stored without dimensions succeeded with other dimensions")
+	}
+	if _, err := newRedisBoardStore(client, legacy, newBoardLayout(10, 10)).Load(); err != nil {
+		t.Fatal(err)
+	}
+	if board, err := newRedisBoardStore(client, legacy, newBoardLayout(12, 10)).Load(); err != nil || len(board[0]) != 10 {
+		t.Errorf("Load() after the dimensions were stored = %v, want the 10x10 board", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// sessionTTL is how long a browser login lasts.
+const sessionTTL = 30 * 24 * time.Hour
+
+// errNoSession is returned when a session token doesn't have a session.
+var errNoSession = errors.New("Session not found")
+
+// sessions stores user session information for browser login. It's
+// replaced by the store selected in main.
+var sessions SessionStore = newMemorySessionStore()
+
+// Each session contains the user information and the oauth state
+// to protect users from CSRF attacks.
+// See https://pkg.go.dev/golang.org/x/oauth2#Config.AuthCodeURL
+type Session struct {
+	User
+	State string
+}
+
+func (s Session) isAuthenticated() bool {
+	return s.Id != 0
+}
+
+// SessionStore maps session tokens to sessions.
+type SessionStore interface {
+	// Get returns a copy of the token's session, so changes to it must be
+	// saved with Set. It returns errNoSession if there isn't one.
+	Get(token string) (*Session, error)
+
+	// Set saves the token's session, which expires after sessionTTL.
+	Set(token string, session Session) error
+
+	// Delete removes the token's session.
+	Delete(token string) error
+}
+
+// newSessionStore creates the SessionStore selected by the SESSION_STORE
+// environment variable. Valid values are "redis", which shares sessions
+// between instances and keeps them across restarts, and "memory". When
+// unset, redis is used if REDIS_HOST is set and memory otherwise.
+func newSessionStore() (SessionStore, error) {
+	kind := os.Getenv("SESSION_STORE")
+	if kind == "" {
+		if _, ok := os.LookupEnv("REDIS_HOST"); ok {
+			kind = "redis"
+		} else {
+			kind = "memory"
+		}
+	}
+
+	switch kind {
+	case "redis":
+		if redisClient == nil {
+			if err := setupRedisClient(); err != nil {
+				return nil, err
+			}
+		}
+		prefix := os.Getenv("REDIS_SESSION_KEY")
+		if prefix == "" {
+			prefix = "rc-place:session"
+		}
+		return newRedisSessionStore(redisClient, prefix), nil
+	case "memory":
+		return newMemorySessionStore(), nil
+	}
+	return nil, errors.New("unknown SESSION_STORE: " + kind)
+}
+
+// memorySessionStore keeps sessions in process memory, which is enough for
+// a single instance. Sessions are lost when the process exits.
+type memorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]memorySession
+}
+
+type memorySession struct {
+	Session
+	expires time.Time
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]memorySession)}
+}
+
+func (s *memorySessionStore) Get(token string) (*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.sessions[token]
+	if !ok || time.Now().After(session.expires) {
+		return nil, errNoSession
+	}
+	return &session.Session, nil
+}
+
+func (s *memorySessionStore) Set(token string, session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[token] = memorySession{Session: session, expires: time.Now().Add(sessionTTL)}
+
+	// drop expired sessions, so logins that were never finished don't
+	// pile up
+	for token, session := range s.sessions {
+		if time.Now().After(session.expires) {
+			delete(s.sessions, token)
+		}
+	}
+	return nil
+}
+
+func (s *memorySessionStore) Delete(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+	return nil
+}
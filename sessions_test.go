@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	store := newMemorySessionStore()
+	if _, err := store.Get("missing"); err != errNoSession {
+		t.Fatalf("Get of a missing session: got %v, want errNoSession", err)
+	}
+
+	store.Set("token", Session{State: "state"})
+	session, err := store.Get("token")
+	if err != nil || session.State != "state" || session.isAuthenticated() {
+		t.Fatalf("Get = %+v, %v, want the unauthenticated session", session, err)
+	}
+
+	// sessions are copies, so changes have to be saved
+	session.User = User{Id: 1, Username: "painter"}
+	if saved, _ := store.Get("token"); saved.isAuthenticated() {
+		t.Fatalf("changing a session changed the stored one")
+	}
+	store.Set("token", *session)
+	if saved, _ := store.Get("token"); !saved.isAuthenticated() {
+		t.Fatalf("Set didn't save the user")
+	}
+
+	// expired sessions are gone
+	store.sessions["token"] = memorySession{Session: *session, expires: time.Now().Add(-time.Second)}
+	if _, err := store.Get("token"); err != errNoSession {
+		t.Fatalf("Get of an expired session: got %v, want errNoSession", err)
+	}
+	store.Set("other", Session{})
+	if _, ok := store.sessions["token"]; ok {
+		t.Errorf("Set should drop expired sessions")
+	}
+
+	store.Delete("other")
+	if _, err := store.Get("other"); err != errNoSession {
+		t.Errorf("Get of a deleted session: got %v, want errNoSession", err)
+	}
+}
+
+func TestSharedStateSelection(t *testing.T) {
+	t.Setenv("SESSION_STORE", "memory")
+	t.Setenv("RATE_LIMIT_STORE", "memory")
+	if store, err := newSessionStore(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := store.(*memorySessionStore); !ok {
+		t.Errorf("SESSION_STORE=memory: got %T", store)
+	}
+	if limiter, err := newRateLimiter(canvasConfig{Name: defaultCanvas}); err != nil {
+		t.Fatal(err)
+	} else if _, ok := limiter.(*tokenBucketLimiter); !ok {
+		t.Errorf("RATE_LIMIT_STORE=memory: got %T", limiter)
+	}
+
+	t.Setenv("SESSION_STORE", "cookie")
+	t.Setenv("RATE_LIMIT_STORE", "cookie")
+	if _, err := newSessionStore(); err == nil {
+		t.Errorf("unknown SESSION_STORE: want an error")
+	}
+	if _, err := newRateLimiter(canvasConfig{Name: defaultCanvas}); err == nil {
+		t.Errorf("unknown RATE_LIMIT_STORE: want an error")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+
+	_ "modernc.org/sqlite"
+)
+
+var sqliteSchema = []string{
+	"CREATE TABLE IF NOT EXISTS tile_info (canvas text NOT NULL DEFAULT 'main', username text, timestamp timestamp DEFAULT CURRENT_TIMESTAMP, x int, y int, color int, UNIQUE(canvas, x, y))",
+	"CREATE TABLE IF NOT EXISTS placements (id integer PRIMARY KEY AUTOINCREMENT, canvas text NOT NULL DEFAULT 'main', username text, timestamp timestamp, x int, y int, color int)",
+	"CREATE TABLE IF NOT EXISTS snapshots (canvas text NOT NULL DEFAULT 'main', timestamp timestamp, width int, height int, board blob)",
+	"CREATE INDEX IF NOT EXISTS placements_canvas_x_y_id ON placements (canvas, x, y, id)",
+	"CREATE INDEX IF NOT EXISTS placements_canvas_timestamp ON placements (canvas, timestamp)",
+	"CREATE INDEX IF NOT EXISTS snapshots_canvas_timestamp ON snapshots (canvas, timestamp)",
+}
+
+// sqliteCanvasMigration adds the canvas column to tables created before
+// there were multiple canvases, keyed by table. sqlite can't drop the
+// unique constraint on tile_info, so it's copied to a new table instead.
+var sqliteCanvasMigration = map[string][]string{
+	"tile_info": {
+		"CREATE TABLE tile_info_canvas (canvas text NOT NULL DEFAULT 'main', username text, timestamp timestamp DEFAULT CURRENT_TIMESTAMP, x int, y int, color int, UNIQUE(canvas, x, y))",
+		"INSERT INTO tile_info_canvas (username, timestamp, x, y, color) SELECT username, timestamp, x, y, color FROM tile_info",
+		"DROP TABLE tile_info",
+		"ALTER TABLE tile_info_canvas RENAME TO tile_info",
+	},
+	"placements": {"ALTER TABLE placements ADD COLUMN canvas text NOT NULL DEFAULT 'main'"},
+	"snapshots":  {"ALTER TABLE snapshots ADD COLUMN canvas text NOT NULL DEFAULT 'main'"},
+}
+
+// newSQLiteMetadataStore opens the sqlite database at path, creating it
+// and the metadata tables if they don't exist yet. The driver is pure Go,
+// so it works in builds without cgo.
+func newSQLiteMetadataStore(path string) (*sqlMetadataStore, error) {
+	// write timestamps in the format sqlite's date functions read, rather
+	// than the driver's default of time.Time.String
+	db, err := sql.Open("sqlite", path+"?_time_format=sqlite")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows a single writer at a time
+	db.SetMaxOpenConns(1)
+
+	if err = migrateSQLiteCanvases(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, statement := range sqliteSchema {
+		if _, err = db.Exec(statement); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &sqlMetadataStore{
+		db:                   db,
+		canvas:               defaultCanvas,
+		upsertQuery:          "INSERT INTO tile_info(canvas, username, x, y, color, timestamp) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (canvas, x, y) DO UPDATE SET username=excluded.username, timestamp=excluded.timestamp, color=excluded.color",
+		selectQuery:          "SELECT username, timestamp FROM tile_info WHERE canvas = ? AND x = ? AND y = ?",
+		regionQuery:          "SELECT x, y, username, timestamp FROM tile_info WHERE canvas = ? AND x >= ? AND x < ? AND y >= ? AND y < ?",
+		editedTilesQuery:     "SELECT x, y, username, color, timestamp FROM tile_info WHERE canvas = ?",
+		insertPlacementQuery: "INSERT INTO placements(canvas, username, x, y, color, timestamp) VALUES (?, ?, ?, ?, ?, ?)",
+		historyQuery:         "SELECT id, username, color, timestamp FROM placements WHERE canvas = ? AND x = ? AND y = ? AND id < ? ORDER BY id DESC LIMIT ?",
+		placementsQuery:      "SELECT id, username, x, y, color, timestamp FROM placements WHERE canvas = ? AND timestamp > ? AND timestamp <= ? ORDER BY id",
+		insertSnapshotQuery:  "INSERT INTO snapshots(canvas, timestamp, width, height, board) VALUES (?, ?, ?, ?, ?)",
+		snapshotQuery:        "SELECT timestamp, width, height, board FROM snapshots WHERE canvas = ? AND timestamp <= ? ORDER BY timestamp DESC LIMIT 1",
+		placeholder:          func(int) string { return "?" },
+	}, nil
+}
+
+// migrateSQLiteCanvases runs sqliteCanvasMigration for every table that
+// exists without a canvas column.
+func migrateSQLiteCanvases(db *sql.DB) error {
+	for table, statements := range sqliteCanvasMigration {
+		var columns, canvasColumns int
+		err := db.QueryRow("SELECT COUNT(*), COUNT(CASE WHEN name = 'canvas' THEN 1 END) FROM pragma_table_info(?)", table).Scan(&columns, &canvasColumns)
+		if err != nil {
+			return err
+		}
+		if columns == 0 || canvasColumns > 0 {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
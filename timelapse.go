@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/gif"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxTimelapseFrames limits how many frames a single timelapse can have.
+	maxTimelapseFrames = 500
+
+	// maxTimelapseScale limits the size of each tile in a timelapse.
+	maxTimelapseScale = 8
+
+	// maxTimelapsePixels limits the pixels of all the frames of a
+	// timelapse, which are held in memory until it's encoded.
+	maxTimelapsePixels = 1 << 27
+
+	// timelapseFrameDelay is the time each frame is shown, in 100ths of a
+	// second.
+	timelapseFrameDelay = 10
+)
+
+// serveTimelapse serves the '/timelapse.gif' route, an animation of the
+// board's history.
+//
+// Query parameters:
+//   - from (REQUIRED): RFC3339 timestamp of the first frame
+//   - to (OPTIONAL, default now): RFC3339 timestamp of the last frame
+//   - frame-interval (OPTIONAL): time between frames, e.g. "10m", defaults
+//     to spreading maxTimelapseFrames evenly between from and to
+//   - scale (OPTIONAL, default 4): size of each tile in pixels
+//
+// Frames are at most maxBoardImageSize pixels wide and high, and all of
+// them together at most maxTimelapsePixels.
+func serveTimelapse(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/timelapse.gif") {
+		return
+	}
+
+	// authenticate
+	if _, err := authPersonalAccessToken(r); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: missing or malformed from: %v", errMalformed, err))
+		return
+	}
+
+	to := time.Now()
+	if t := query.Get("to"); t != "" {
+		if to, err = time.Parse(time.RFC3339, t); err != nil {
+			writeError(w, fmt.Errorf("%w: malformed to: %v", errMalformed, err))
+			return
+		}
+	}
+	if !to.After(from) {
+		writeError(w, fmt.Errorf("%w: to must be after from", errMalformed))
+		return
+	}
+
+	span := to.Sub(from)
+	interval := (span + maxTimelapseFrames - 2) / (maxTimelapseFrames - 1)
+	if i := query.Get("frame-interval"); i != "" {
+		if interval, err = time.ParseDuration(i); err != nil || interval <= 0 {
+			writeError(w, fmt.Errorf("%w: malformed frame-interval: %v", errMalformed, err))
+			return
+		}
+	}
+	frames := (span+interval-1)/interval + 1
+	if frames > maxTimelapseFrames {
+		writeError(w, fmt.Errorf("%w: too many frames requested", errMalformed))
+		return
+	}
+
+	scale := 4
+	if s := query.Get("scale"); s != "" {
+		if scale, err = strconv.Atoi(s); err != nil || scale < 1 || scale > maxTimelapseScale {
+			writeError(w, fmt.Errorf("%w: malformed scale", errMalformed))
+			return
+		}
+	}
+
+	// the board only grows, so no frame is larger than the current board
+	view := hub.view()
+	frameWidth, frameHeight := view.width()*scale, view.height()*scale
+	if frameWidth > maxBoardImageSize || frameHeight > maxBoardImageSize || int64(frames)*int64(frameWidth)*int64(frameHeight) > maxTimelapsePixels {
+		writeError(w, fmt.Errorf("%w: the timelapse would be too large, use a smaller scale or fewer frames", errMalformed))
+		return
+	}
+
+	animation, err := hub.timelapse(from, to, interval, scale)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// encode to a buffer first so errors can still be reported
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, animation); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// timelapse renders one frame of the board every interval from from until
+// to, including a final frame at to.
+func (h *Hub) timelapse(from, to time.Time, interval time.Duration, scale int) (*gif.GIF, error) {
+	board, err := h.boardAt(from)
+	if err != nil {
+		return nil, err
+	}
+	placements, err := h.metadata.GetPlacements(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	palette := h.palette.ImagePalette()
+	animation := &gif.GIF{}
+	addFrame := func() {
+		animation.Image = append(animation.Image, renderPaletted(board, palette, scale))
+		animation.Delay = append(animation.Delay, timelapseFrameDelay)
+	}
+
+	addFrame()
+	next := 0
+	for frameTime := from.Add(interval); ; frameTime = frameTime.Add(interval) {
+		if frameTime.After(to) {
+			frameTime = to
+		}
+		for ; next < len(placements) && !placements[next].Timestamp.After(frameTime); next++ {
+			p := placements[next]
+			if p.Y < len(board) && p.X < len(board[p.Y]) {
+				board[p.Y][p.X] = p.Color
+			}
+		}
+		addFrame()
+		if !frameTime.Before(to) {
+			break
+		}
+	}
+	return animation, nil
+}
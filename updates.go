@@ -0,0 +1,52 @@
+package main
+
+// updateLogSize is the number of recent updates the hub keeps so clients
+// can resume a session without reloading the board. Missed updates are
+// queued all at once, so more than fit in a client's send buffer are never
+// needed.
+const updateLogSize = sendBufferSize
+
+// update is a placement applied by the hub, numbered in the order they
+// were applied.
+type update struct {
+	Seq uint64
+	InternalMessage
+}
+
+// updateLog is a ring buffer of the most recent updates.
+type updateLog struct {
+	updates [updateLogSize]update
+	// next is the index the next update is written to.
+	next int
+	size int
+}
+
+func (l *updateLog) add(u update) {
+	l.updates[l.next] = u
+	l.next = (l.next + 1) % updateLogSize
+	if l.size < updateLogSize {
+		l.size++
+	}
+}
+
+// since returns the updates with a sequence number greater than seq, oldest
+// first. It returns false if any of them are no longer in the log.
+func (l *updateLog) since(seq uint64) ([]update, bool) {
+	if l.size == 0 {
+		return nil, false
+	}
+	oldest := (l.next - l.size + updateLogSize) % updateLogSize
+	newest := (l.next - 1 + updateLogSize) % updateLogSize
+	if seq+1 < l.updates[oldest].Seq || seq > l.updates[newest].Seq {
+		return nil, false
+	}
+
+	missed := []update{}
+	for i := 0; i < l.size; i++ {
+		u := l.updates[(oldest+i)%updateLogSize]
+		if u.Seq > seq {
+			missed = append(missed, u)
+		}
+	}
+	return missed, true
+}